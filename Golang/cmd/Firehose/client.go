@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/irc"
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// How long a client has to send a valid PASS after connecting
+const authTimeout = 10 * time.Second
+
+var (
+	// Capabilities a client is allowed to request with CAP REQ
+	supportedCapabilities = map[string]struct{}{
+		capabilityTags:         {},
+		capabilityCommands:     {},
+		capabilityMembership:   {},
+		tcp.CapabilityFirehose: {},
+	}
+)
+
+// Acquires a channel for holder, joining it upstream if nobody had it yet
+func (app *Application) joinChannel(holder interface{}, channel string) {
+	defer app.Membership.Lock(channel)()
+
+	var dbChannel dbmodels.ChannelTable
+	result := app.DB.First(&dbChannel, "name = ?", channel)
+
+	perm := dbmodels.WritePermission
+	holders := []interface{}{holder}
+
+	if result.Error == nil {
+		perm = dbChannel.GetBotPermission()
+		app.Intervals.Set(channel, dbChannel.GetMessageInterval())
+
+		// The bot might have joined the channel after startup
+		holders = append(holders, databaseHolder{})
+	}
+
+	if !app.Membership.AcquireAll(channel, holders...) {
+		return
+	}
+
+	zap.S().Infof("Joining %s upstream", channel)
+
+	app.TMI.Join(channel)
+	app.Scheduler.AddChannel(channel, perm)
+}
+
+// Releases holder's reference to a channel, departing upstream if nobody needs it anymore
+func (app *Application) partChannel(holder interface{}, channel string) {
+	defer app.Membership.Lock(channel)()
+
+	if !app.Membership.Release(channel, holder) {
+		if !app.Membership.OnlyHeldBy(channel, databaseHolder{}) {
+			return
+		}
+
+		// The bot might have left the channel, in which case it's no longer in bot.channels
+		var count int64
+		result := app.DB.Model(&dbmodels.ChannelTable{}).Where("name = ?", channel).Count(&count)
+		if result.Error != nil || count > 0 {
+			return
+		}
+
+		if !app.Membership.Release(channel, databaseHolder{}) {
+			return
+		}
+	}
+
+	app.departChannel(channel)
+}
+
+// Releases every channel holder holds, departing the ones nobody needs anymore
+func (app *Application) releaseChannels(holder interface{}) {
+	for _, channel := range app.Membership.Channels(holder) {
+		unlock := app.Membership.Lock(channel)
+
+		if app.Membership.Release(channel, holder) {
+			app.departChannel(channel)
+		}
+
+		unlock()
+	}
+}
+
+// Leaves a channel upstream, the channel's lock has to be held
+func (app *Application) departChannel(channel string) {
+	zap.S().Infof("Departing %s upstream", channel)
+
+	_ = app.Scheduler.RemoveChannel(channel)
+	app.Intervals.Set(channel, 0)
+	app.RoomStates.Forget(channel)
+	app.SlowMode.Set(channel, 0)
+	app.Backoff.Forget(channel)
+	app.Sent.Forget(channel)
+
+	app.TMI.Depart(channel)
+
+	app.State.Forget(channel)
+}
+
+func (app *Application) onTCPClient(c tcp.Conn) {
+	zap.S().Info("Client connected")
+
+	session := NewSession(c)
+
+	// A client which never sends PASS would hold on to a connection slot forever
+	authDeadline := time.AfterFunc(authTimeout, func() {
+		if c.IsAuthenticated() {
+			return
+		}
+
+		zap.S().Warnf("Closing client %s which did not authenticate within %s", c.RemoteAddr(), authTimeout)
+
+		c.WriteString(":tmi.twitch.tv NOTICE * :Login authentication failed\r\n")
+		_ = c.Close()
+	})
+	defer authDeadline.Stop()
+
+	defer app.releaseChannels(c)
+
+	for {
+		msg, err := c.ReadString()
+
+		if err != nil {
+			var opErr *net.OpError
+
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &opErr) /* wsarecv on winblows */ {
+				zap.S().Info("Client disconnected")
+			} else {
+				zap.S().Error(err)
+			}
+
+			return
+		}
+
+		line, err := irc.Parse(msg)
+		if err != nil {
+			zap.S().Debugf("Ignoring invalid message from client: %s", err)
+			continue
+		}
+
+		if !session.IsAuthenticated() {
+			switch line.Command {
+			case "CAP":
+				// Capabilities are negotiated before PASS is sent
+			case "PASS":
+				if session.Authenticate(app.Config, line.Param(0)) {
+					zap.S().Infof("Client authenticated as %s", session.Client.Name)
+					continue
+				}
+
+				fallthrough
+			default:
+				zap.S().Warnf("Closing unauthenticated client %s", c.RemoteAddr())
+
+				c.WriteString(":tmi.twitch.tv 464 * :Password incorrect\r\n")
+				return
+			}
+		}
+
+		/*
+			Due to mimicking a IRC server,
+			we have to manually handle certain commands like JOIN, PART and NICK
+			because the actual connection has been established to Twitch a long time ago.
+		*/
+		switch line.Command {
+		case "JOIN":
+			for _, channel := range splitChannels(line.Param(0)) {
+				zap.S().Infof("Received JOIN for %s", channel)
+
+				if !session.CanJoin(channel) {
+					app.notice(c, channel, noticeJoinForbidden, "You are not allowed to join this channel.")
+					continue
+				}
+
+				app.joinChannel(c, channel)
+
+				c.JoinChannel(channel)
+
+				reply := app.formatTwitchMsg(fmt.Sprintf("JOIN #%s", channel))
+
+				c.WriteString(reply)
+
+				// Empty if upstream has not joined yet, the state is forwarded once it has
+				app.replay(c, app.State.Channel(channel)...)
+
+			}
+		case "PART":
+			for _, channel := range splitChannels(line.Param(0)) {
+				zap.S().Infof("Received PART for %s", channel)
+
+				c.PartChannel(channel)
+
+				app.partChannel(c, channel)
+
+				reply := app.formatTwitchMsg(fmt.Sprintf("PART #%s", channel))
+
+				c.WriteString(reply)
+
+			}
+		case "NICK":
+			// Some clients expect a response for some commands
+			c.WriteString(app.createInitialJoinMessage())
+
+			app.replay(c, app.State.GlobalUserState())
+
+		case "CAP":
+			// Same with nick
+			if strings.ToUpper(line.Param(0)) != "REQ" {
+				continue
+			}
+
+			requested := strings.Fields(line.Trailing())
+
+			// A request is acknowledged or refused as a whole
+			if !session.CanRequest(requested) {
+				c.WriteString(fmt.Sprintf(":tmi.twitch.tv CAP * NAK :%s\r\n", strings.Join(requested, " ")))
+				continue
+			}
+
+			for _, capability := range requested {
+				c.AddCapability(capability)
+			}
+
+			c.WriteString(fmt.Sprintf(":tmi.twitch.tv CAP * ACK :%s\r\n", strings.Join(requested, " ")))
+
+		case "PING":
+			c.WriteString(fmt.Sprintf(":tmi.twitch.tv PONG tmi.twitch.tv :%s\r\n", line.Trailing()))
+
+		case "PRIVMSG":
+			channel := line.Channel()
+			if channel == "" || len(line.Params) < 2 {
+				continue
+			}
+
+			if !session.CanSend(channel) {
+				app.notice(c, channel, noticeSendForbidden, "You are not allowed to send messages to this channel.")
+				continue
+			}
+
+			ctx := newMessageContext(session, channel, line)
+
+			if ctx.ReplyTo != nil {
+				zap.S().Infof("Replying in %s with %s", channel, ctx.Message)
+			} else {
+				zap.S().Infof("Sending %s to %s", ctx.Message, channel)
+			}
+
+			err := app.Scheduler.AddMessage(ctx)
+
+			switch err {
+			case nil:
+				app.Lifecycle.Track(ctx, StateQueued, "")
+			case messagescheduler.ErrCollapsed:
+				app.Lifecycle.Track(ctx, StateDropped, err.Error())
+			default:
+				app.Lifecycle.Track(ctx, StateRejected, err.Error())
+			}
+
+			switch err {
+			case nil:
+				if !ctx.SendAt.IsZero() {
+					app.messageNotice(c, ctx, noticeScheduled, fmt.Sprintf("Your message was scheduled with ID %s.", ctx.ID))
+				} else {
+					app.messageNotice(c, ctx, noticeQueued, fmt.Sprintf("Your message was queued with ID %s.", ctx.ID))
+				}
+			case messagescheduler.ErrCollapsed:
+				app.messageNotice(c, ctx, noticeCollapsed, "An identical message is already queued.")
+			case messagescheduler.ErrQueueFull:
+				app.messageNotice(c, ctx, noticeQueueFull, "Your message was rejected because the queue is full.")
+			case messagescheduler.ErrChanNotFound:
+				app.messageNotice(c, ctx, noticeNotJoined, "Your message was rejected because the channel is not joined.")
+			case messagescheduler.ErrReadOnly:
+				app.messageNotice(c, ctx, noticeReadOnly, "Your message was rejected because the bot is not allowed to speak in this channel.")
+			default:
+				zap.S().Errorw("Failed to queue message", "channel", channel, "error", err)
+				app.messageNotice(c, ctx, noticeRejected, "Your message could not be queued.")
+			}
+		}
+	}
+}
+
+// Builds the message to queue from a client's PRIVMSG, applying the melon- tags
+func newMessageContext(session *Session, channel string, line *irc.Message) messagescheduler.MessageContext {
+	now := time.Now()
+
+	ctx := messagescheduler.MessageContext{
+		ID:       uuid.NewString(),
+		Channel:  channel,
+		Message:  line.Trailing(),
+		Tags:     line.Tags,
+		QueuedAt: now,
+		ClientID: session.Conn.ID(),
+	}
+
+	if replyParentMsgID, ok := line.Tag("reply-parent-msg-id"); ok && replyParentMsgID != "" {
+		ctx.ReplyTo = &replyParentMsgID
+	}
+
+	if priority, ok := line.Tag(messagescheduler.PriorityTag); ok {
+		p, err := messagescheduler.ParsePriority(priority)
+		if err != nil {
+			zap.S().Debugw("Ignoring invalid priority", "priority", priority)
+		}
+
+		ctx.Priority = p
+	}
+
+	if tag, ok := line.Tag(messagescheduler.SendAtTag); ok {
+		sendAt, err := messagescheduler.ParseSendAt(tag)
+		if err != nil {
+			zap.S().Debugw("Ignoring invalid send-at", "send-at", tag)
+		} else {
+			ctx.SendAt = sendAt
+		}
+	} else if tag, ok := line.Tag(messagescheduler.DelayTag); ok {
+		delay, err := messagescheduler.ParseDelay(tag)
+		if err != nil {
+			zap.S().Debugw("Ignoring invalid delay", "delay", tag)
+		} else if delay > 0 {
+			ctx.SendAt = now.Add(delay)
+		}
+	}
+
+	ttl := session.MessageTTL()
+	if tag, ok := line.Tag(messagescheduler.TTLTag); ok {
+		t, err := messagescheduler.ParseTTL(tag)
+		if err != nil {
+			zap.S().Debugw("Ignoring invalid ttl", "ttl", tag)
+		} else {
+			ttl = t
+		}
+	}
+
+	// A delayed message's TTL starts once it is due
+	if ttl > 0 {
+		if ctx.SendAt.After(now) {
+			ctx.Deadline = ctx.SendAt.Add(ttl)
+		} else {
+			ctx.Deadline = now.Add(ttl)
+		}
+	}
+
+	return ctx
+}
+
+// Tells the client a message was dropped instead of being sent
+func (app *Application) onScheduleDrop(ctx messagescheduler.MessageContext, reason error) {
+	zap.S().Infow("Dropped message", "channel", ctx.Channel, "reason", reason)
+
+	if reason == messagescheduler.ErrExpired {
+		app.Lifecycle.Track(ctx, StateExpired, reason.Error())
+	} else {
+		app.Lifecycle.Track(ctx, StateDropped, reason.Error())
+	}
+
+	switch reason {
+	case messagescheduler.ErrExpired:
+		app.feedback(ctx, noticeExpired, "Your message expired before it could be sent.")
+	case messagescheduler.ErrQueueFull:
+		app.feedback(ctx, noticeDropped, "Your message was dropped to make room for newer messages.")
+	case messagescheduler.ErrChannelRemoved:
+		app.feedback(ctx, noticeDropped, "Your message was dropped because the channel was left.")
+	case messagescheduler.ErrChanNotFound:
+		app.feedback(ctx, noticeNotJoined, "Your message was dropped because the channel is not joined.")
+	case messagescheduler.ErrReadOnly:
+		app.feedback(ctx, noticeReadOnly, "Your message was dropped because the bot is not allowed to speak in this channel.")
+	case messagescheduler.ErrEmoteOnly, messagescheduler.ErrFollowersOnly, messagescheduler.ErrSubsOnly:
+		app.feedback(ctx, noticeDropped, fmt.Sprintf("Your message was dropped because the %s.", reason))
+	default:
+		app.feedback(ctx, noticeDropped, "Your message was dropped.")
+	}
+}
+
+// Tells the client a message is kept in the queue until the channel allows it
+func (app *Application) onScheduleHold(ctx messagescheduler.MessageContext, reason error) {
+	zap.S().Infow("Holding message", "channel", ctx.Channel, "reason", reason)
+
+	for _, mode := range []error{messagescheduler.ErrEmoteOnly, messagescheduler.ErrFollowersOnly, messagescheduler.ErrSubsOnly} {
+		if errors.Is(reason, mode) {
+			app.feedback(ctx, noticeHeld, fmt.Sprintf("Your message is held because the %s.", mode))
+			return
+		}
+	}
+}
+
+// Splits a JOIN or PART parameter such as "#foo,#bar" into lowercase channel names
+func splitChannels(param string) []string {
+	channels := make([]string, 0)
+
+	for _, channel := range strings.Split(param, ",") {
+		channel = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(channel), "#"))
+		if channel == "" {
+			continue
+		}
+
+		channels = append(channels, channel)
+	}
+
+	return channels
+}
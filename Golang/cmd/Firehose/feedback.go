@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/irc"
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+)
+
+// msg-id values of the NOTICEs Firehose sends its clients
+const (
+	noticeJoinForbidden = "melon_join_forbidden"
+	noticeSendForbidden = "melon_send_forbidden"
+	noticeQueued        = "melon_message_queued"
+	noticeScheduled     = "melon_message_scheduled"
+	noticeSent          = "melon_message_sent"
+	noticeHeld          = "melon_message_held"
+	noticeExpired       = "melon_message_expired"
+	noticeQueueFull     = "melon_queue_full"
+	noticeCollapsed     = "melon_message_collapsed"
+	noticeDropped       = "melon_message_dropped"
+	noticeNotJoined     = "melon_channel_not_joined"
+	noticeReadOnly      = "melon_channel_read_only"
+	noticeRatelimited   = "melon_message_ratelimited"
+	noticeRetried       = "melon_message_retried"
+	noticeRejected      = "melon_message_rejected"
+)
+
+// Tag a client can set on a PRIVMSG, it is echoed on every NOTICE about that message
+const clientNonceTag = "client-nonce"
+
+// Sends a NOTICE to a single client
+func (app *Application) notice(c tcp.Conn, channel, msgID, text string) {
+	writeNotice(c, channel, map[string]string{"msg-id": msgID}, text)
+}
+
+// Sends a NOTICE about a message to the client which sent it
+func (app *Application) messageNotice(c tcp.Conn, ctx messagescheduler.MessageContext, msgID, text string) {
+	tags := map[string]string{"msg-id": msgID}
+
+	if nonce, ok := ctx.Tags[clientNonceTag]; ok && nonce != "" {
+		tags[clientNonceTag] = nonce
+	}
+
+	writeNotice(c, ctx.Channel, tags, text)
+}
+
+// Like messageNotice, for when the client has to be looked up
+//
+// Nothing is sent if the client has disconnected, or the message was restored after a restart
+func (app *Application) feedback(ctx messagescheduler.MessageContext, msgID, text string) {
+	c, ok := app.TCPServer.Get(ctx.ClientID)
+	if !ok {
+		return
+	}
+
+	app.messageNotice(c, ctx, msgID, text)
+}
+
+// Written like a NOTICE from Twitch, so a client without twitch.tv/commands doesn't receive it
+func writeNotice(c tcp.Conn, channel string, tags map[string]string, text string) {
+	target := "*"
+	if channel != "" {
+		target = "#" + channel
+	}
+
+	msg := &irc.Message{
+		Tags:    tags,
+		Prefix:  &irc.Prefix{Name: "tmi.twitch.tv"},
+		Command: "NOTICE",
+		Params:  []string{target, text},
+	}
+
+	raw := msg.String()
+
+	if line := formatForClient(c, msg.Command, raw, stripTags(raw)); line != "" {
+		c.WriteString(line)
+	}
+}
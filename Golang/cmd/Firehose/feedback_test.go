@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+)
+
+func TestWriteNotice(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []string
+		expected     string
+	}{
+		{"tags and commands", []string{capabilityTags, capabilityCommands}, "@msg-id=melon_message_sent :tmi.twitch.tv NOTICE #forsen :Your message was sent.\r\n"},
+		{"commands", []string{capabilityCommands}, ":tmi.twitch.tv NOTICE #forsen :Your message was sent.\r\n"},
+		{"tags", []string{capabilityTags}, ""},
+		{"none", nil, ""},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+
+		c := tcp.NewConnection(1, server, tcp.Options{})
+
+		for _, capability := range test.capabilities {
+			c.AddCapability(capability)
+		}
+
+		writeNotice(c, "forsen", map[string]string{"msg-id": noticeSent}, "Your message was sent.")
+
+		if test.expected == "" {
+			// Clients without twitch.tv/commands don't receive NOTICEs from Twitch either
+			if c.Queued() != 0 {
+				t.Errorf("%s: expected nothing to be written, %d messages queued", test.name, c.Queued())
+			}
+		} else {
+			_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+			line, err := bufio.NewReader(client).ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			if line != test.expected {
+				t.Errorf("%s: expected %q, got %q", test.name, test.expected, line)
+			}
+		}
+
+		c.Close()
+		client.Close()
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/irc"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+	"go.uber.org/zap"
+)
+
+const (
+	capabilityTags       = "twitch.tv/tags"
+	capabilityCommands   = "twitch.tv/commands"
+	capabilityMembership = "twitch.tv/membership"
+)
+
+var (
+	// Upstream messages which belong to the upstream connection itself and are never forwarded
+	//
+	// Clients get their own from Firehose when they connect
+	connectionCommands = map[string]struct{}{
+		"PING": {},
+		"PONG": {},
+		"CAP":  {},
+		"001":  {},
+		"002":  {},
+		"003":  {},
+		"004":  {},
+		"372":  {},
+		"375":  {},
+		"376":  {},
+		// Asks a single upstream connection to reconnect, which the pool does by itself
+		"RECONNECT": {},
+	}
+
+	// Messages only sent to clients which requested a capability, like TMI does
+	//
+	// See https://dev.twitch.tv/docs/irc/capabilities/
+	capabilityForCommand = map[string]string{
+		"JOIN":            capabilityMembership,
+		"PART":            capabilityMembership,
+		"353":             capabilityMembership,
+		"366":             capabilityMembership,
+		"CLEARCHAT":       capabilityCommands,
+		"CLEARMSG":        capabilityCommands,
+		"GLOBALUSERSTATE": capabilityCommands,
+		"HOSTTARGET":      capabilityCommands,
+		"NOTICE":          capabilityCommands,
+		"ROOMSTATE":       capabilityCommands,
+		"USERNOTICE":      capabilityCommands,
+		"USERSTATE":       capabilityCommands,
+		"WHISPER":         capabilityCommands,
+	}
+)
+
+// Forwards a raw upstream message to every client that should receive it
+func (app *Application) forward(raw string) {
+	msg, err := irc.Parse(raw)
+	if err != nil {
+		zap.S().Debugf("Ignoring invalid message from upstream: %s", err)
+		return
+	}
+
+	if _, ok := connectionCommands[msg.Command]; ok {
+		return
+	}
+
+	// Firehose answers JOIN and PART from clients itself, so the bot's own would be duplicates
+	if (msg.Command == "JOIN" || msg.Command == "PART") &&
+		msg.Prefix != nil &&
+		msg.Prefix.Name == app.Config.BotUsername {
+		return
+	}
+
+	app.State.Update(msg)
+
+	channel := msg.Channel()
+
+	if msg.Command == "ROOMSTATE" {
+		app.onRoomState(channel, msg)
+	}
+
+	// 353 and 366 have the channel further back, #channel is the last param before the trailing one
+	if msg.Command == "353" || msg.Command == "366" {
+		for _, param := range msg.Params {
+			if strings.HasPrefix(param, "#") {
+				channel = strings.ToLower(strings.TrimPrefix(param, "#"))
+				break
+			}
+		}
+	}
+
+	untagged := stripTags(raw)
+
+	app.TCPServer.BroadcastWith(channel, func(c tcp.Conn) string {
+		return formatForClient(c, msg.Command, raw, untagged)
+	})
+}
+
+// Keeps the room state of a channel up to date, the ROOMSTATE might only contain what changed
+func (app *Application) onRoomState(channel string, msg *irc.Message) {
+	state := app.RoomStates.Update(channel, msg.Tags)
+	app.SlowMode.Update(channel, state)
+
+	zap.S().Debugw("Room state changed", "channel", channel, "state", state)
+
+	// Lets held messages through, or makes the channel follow a new slow mode
+	app.Scheduler.Reschedule(channel)
+}
+
+// Replays cached state messages to a single client
+func (app *Application) replay(c tcp.Conn, states ...*irc.Message) {
+	for _, state := range states {
+		if state == nil {
+			continue
+		}
+
+		raw := state.String()
+
+		if line := formatForClient(c, state.Command, raw, stripTags(raw)); line != "" {
+			c.WriteString(line)
+		}
+	}
+}
+
+// Formats a message the way a client asked for it with its capabilities
+//
+// Returns an empty string if the client should not receive it
+func formatForClient(c tcp.Conn, command, raw, untagged string) string {
+	if capability, ok := capabilityForCommand[command]; ok && !c.HasCapability(capability) {
+		return ""
+	}
+
+	if !c.HasCapability(capabilityTags) {
+		return untagged + "\r\n"
+	}
+
+	return raw + "\r\n"
+}
+
+// Removes the tags of a raw message
+func stripTags(raw string) string {
+	if !strings.HasPrefix(raw, "@") {
+		return raw
+	}
+
+	_, rest, _ := strings.Cut(raw, " ")
+
+	return strings.TrimLeft(rest, " ")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/redis"
+	"go.uber.org/zap"
+)
+
+type MessageState string
+
+const (
+	// Waiting in a channel's queue, or for its send-at time
+	StateQueued MessageState = "queued"
+	// Handed to Twitch
+	StateSent MessageState = "sent"
+	// Twitch accepted the message and gave it an ID
+	StateEchoed MessageState = "echoed"
+	// Refused by Firehose when queued, or by Twitch after being sent
+	StateRejected MessageState = "rejected"
+	// Not sent before its TTL ran out
+	StateExpired MessageState = "expired"
+	// Removed from the queue before it was sent
+	StateDropped MessageState = "dropped"
+)
+
+const (
+	// How long a message can be looked up after its last change
+	messageRecordTTL = time.Hour
+	// Records are stored at Firehose:Message:<id>
+	messageRecordKey = "Firehose:Message:"
+	// Changes waiting to be written, further changes are discarded once it's full
+	lifecycleQueueSize = 1024
+)
+
+// MessageRecord is the last known state of a message sent by a client
+type MessageRecord struct {
+	ID          string       `json:"id"`
+	Channel     string       `json:"channel"`
+	Message     string       `json:"message"`
+	State       MessageState `json:"state"`
+	Reason      string       `json:"reason,omitempty"`
+	TwitchID    string       `json:"twitch_id,omitempty"`
+	ClientNonce string       `json:"client_nonce,omitempty"`
+	QueuedAt    time.Time    `json:"queued_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+func (MessageRecord) Type() string {
+	return "message.lifecycle"
+}
+
+// Lifecycle records the state of every message, publishing each change on redis.PubKeyMessageLifecycle
+//
+// Changes are written in the order they happen by a single goroutine, so sending messages never waits on redis
+type Lifecycle struct {
+	ctx     context.Context
+	redis   redis.Instance
+	updates chan MessageRecord
+}
+
+func NewLifecycle(ctx context.Context, r redis.Instance) *Lifecycle {
+	l := &Lifecycle{
+		ctx:     ctx,
+		redis:   r,
+		updates: make(chan MessageRecord, lifecycleQueueSize),
+	}
+
+	go l.run()
+
+	return l
+}
+
+// Track moves a message to state, reason says why for states other than queued, sent and echoed
+func (l *Lifecycle) Track(msg messagescheduler.MessageContext, state MessageState, reason string) {
+	l.update(newMessageRecord(msg, state, reason))
+}
+
+// Echoed records the ID Twitch gave a message which was sent
+func (l *Lifecycle) Echoed(msg messagescheduler.MessageContext, twitchID string) {
+	record := newMessageRecord(msg, StateEchoed, "")
+	record.TwitchID = twitchID
+
+	l.update(record)
+}
+
+// Get returns the record of a message, redis.Nil if there is none or it has expired
+func (l *Lifecycle) Get(ctx context.Context, id string) (MessageRecord, error) {
+	var record MessageRecord
+
+	data, err := l.redis.Get(ctx, recordKey(id))
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal([]byte(data), &record)
+
+	return record, err
+}
+
+func (l *Lifecycle) update(record MessageRecord) {
+	select {
+	case l.updates <- record:
+	default:
+		zap.S().Warnw("Too many message records waiting to be written, discarding", "id", record.ID, "state", record.State)
+	}
+}
+
+func (l *Lifecycle) run() {
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case record := <-l.updates:
+			l.write(record)
+		}
+	}
+}
+
+// Stores and publishes a record in a single round trip
+func (l *Lifecycle) write(record MessageRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		zap.S().Errorw("Failed to encode message record", "id", record.ID, "error", err)
+		return
+	}
+
+	err = l.redis.SetAndPublish(l.ctx, recordKey(record.ID), string(data), messageRecordTTL, redis.PubKeyMessageLifecycle, record)
+	if err != nil {
+		zap.S().Errorw("Failed to write message record", "id", record.ID, "error", err)
+	}
+}
+
+func newMessageRecord(msg messagescheduler.MessageContext, state MessageState, reason string) MessageRecord {
+	return MessageRecord{
+		ID:          msg.ID,
+		Channel:     msg.Channel,
+		Message:     msg.Message,
+		State:       state,
+		Reason:      reason,
+		ClientNonce: msg.Tags[clientNonceTag],
+		QueuedAt:    msg.QueuedAt,
+		UpdatedAt:   time.Now(),
+	}
+}
+
+func recordKey(id string) redis.Key {
+	return redis.Key(messageRecordKey + id)
+}
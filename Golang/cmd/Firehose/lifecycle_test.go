@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/redis"
+)
+
+type writtenRecord struct {
+	key        redis.Key
+	record     MessageRecord
+	expiration time.Duration
+	channel    redis.Key
+}
+
+// Only implements what Lifecycle writes with, anything else panics
+type fakeRedis struct {
+	redis.Instance
+
+	written chan writtenRecord
+	// Closed to let writes through
+	release chan struct{}
+}
+
+func (f *fakeRedis) SetAndPublish(ctx context.Context, key redis.Key, value string, expiration time.Duration, channel redis.Key, data redis.PubJSON) error {
+	<-f.release
+
+	var record MessageRecord
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return err
+	}
+
+	f.written <- writtenRecord{key: key, record: record, expiration: expiration, channel: channel}
+
+	return nil
+}
+
+func TestLifecycleWritesInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRedis{
+		written: make(chan writtenRecord, lifecycleQueueSize+10),
+		release: make(chan struct{}),
+	}
+
+	l := NewLifecycle(ctx, r)
+
+	msg := messagescheduler.MessageContext{ID: "1", Channel: "forsen", Message: "hi"}
+
+	// Tracking doesn't wait on redis
+	done := make(chan struct{})
+	go func() {
+		l.Track(msg, StateQueued, "")
+		l.Track(msg, StateSent, "")
+		l.Echoed(msg, "abc")
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tracking waited on redis")
+	}
+
+	close(r.release)
+
+	for _, expected := range []MessageState{StateQueued, StateSent, StateEchoed} {
+		select {
+		case written := <-r.written:
+			if written.record.State != expected {
+				t.Errorf("Expected %s, got %s", expected, written.record.State)
+			}
+
+			if written.key != "Firehose:Message:1" || written.expiration != messageRecordTTL || written.channel != redis.PubKeyMessageLifecycle {
+				t.Errorf("Unexpected write %+v", written)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", expected)
+		}
+	}
+}
+
+func TestLifecycleDiscardsWhenFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRedis{
+		written: make(chan writtenRecord, lifecycleQueueSize+10),
+		release: make(chan struct{}),
+	}
+
+	l := NewLifecycle(ctx, r)
+
+	msg := messagescheduler.MessageContext{ID: "1", Channel: "forsen", Message: "hi"}
+
+	// One is taken by the writer, which waits on redis, the rest fill the queue and then some
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < lifecycleQueueSize+5; i++ {
+			l.Track(msg, StateQueued, "")
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tracking blocked while the queue was full")
+	}
+
+	close(r.release)
+
+	deadline := time.After(5 * time.Second)
+	for len(r.written) < lifecycleQueueSize {
+		select {
+		case <-deadline:
+			t.Fatalf("Expected at least %d records to be written, got %d", lifecycleQueueSize, len(r.written))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if n := len(r.written); n > lifecycleQueueSize+1 {
+		t.Errorf("Expected records past the queue size to be discarded, %d written", n)
+	}
+}
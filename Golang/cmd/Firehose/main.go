@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
-	"flag"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
-	"regexp"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	applicationwrapper "github.com/JoachimFlottorp/Melonbot/Golang/internal/application_wrapper"
 	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
@@ -17,6 +20,7 @@ import (
 	"github.com/JoachimFlottorp/Melonbot/Golang/internal/redis"
 	"github.com/JoachimFlottorp/Melonbot/Golang/internal/status"
 	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+	tmipool "github.com/JoachimFlottorp/Melonbot/Golang/internal/tmi_pool"
 	"github.com/gempir/go-twitch-irc/v4"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -24,26 +28,30 @@ import (
 
 const (
 	messageEvasionCharacter = "\U000e0000"
+	// How long queued messages are given to be sent when shutting down, it has to be shorter than the wrapper's timeout
+	schedulerShutdownTimeout = 5 * time.Second
 )
 
-var (
-	isReplyRegex        = regexp.MustCompile(`@reply-parent-msg-id=([\da-f]{8}-[\da-f]{4}-4[\da-f]{3}-[89ab][\da-f]{3}-[\da-f]{12}) PRIVMSG #(\w+) :(.*)`)
-	extractPrivmsgRegex = regexp.MustCompile(`PRIVMSG #(\w+) :(.*)`)
-)
-
-func init() {
-	flag.Parse()
-}
-
 type Application struct {
-	TMI          *twitch.Client
+	TMI          *tmipool.Pool
 	TCPServer    *tcp.Server
 	HealthServer *status.Server
 	DB           *gorm.DB
 	Redis        redis.Instance
 	Config       *config.Config
 	Scheduler    *messagescheduler.MessageScheduler
-	LastMessage  map[string]string
+	// Intervals broadcasters asked for in bot.channels
+	Intervals *messagescheduler.IntervalPolicy
+	// ROOMSTATE of every joined channel
+	RoomStates *messagescheduler.RoomStates
+	// Slow mode of every joined channel
+	SlowMode *messagescheduler.SlowModePolicy
+	// Channels held back after Twitch refused a message
+	Backoff    *messagescheduler.BackoffPolicy
+	Membership *Membership
+	State      *StateCache
+	Sent       *SentMessages
+	Lifecycle  *Lifecycle
 }
 
 type ChannelUpdateMode struct {
@@ -96,15 +104,10 @@ func (app *Application) formatTwitchMsg(msg string) string {
 }
 
 func (app *Application) RunTMI(ctx context.Context) {
-	// FIXME: Can this be put into a single function
-	app.TMI.OnPrivateMessage(func(message twitch.PrivateMessage) {
-		app.TCPServer.Broadcast(message.Raw + "\r\n")
-	})
+	app.TMI.OnRawMessage(app.forward)
 
 	app.TMI.OnNoticeMessage(func(message twitch.NoticeMessage) {
-		zap.S().Debug(message.Raw)
-
-		app.TCPServer.Broadcast(message.Raw + "\r\n")
+		app.onNotice(ctx, message)
 	})
 
 	app.TMI.OnSelfJoinMessage(func(message twitch.UserJoinMessage) {
@@ -116,18 +119,18 @@ func (app *Application) RunTMI(ctx context.Context) {
 		zap.S().Infof("Left channel %s", message.Channel)
 	})
 
-	app.TMI.OnUserJoinMessage(func(message twitch.UserJoinMessage) {
-		app.TCPServer.Broadcast(message.Raw + "\r\n")
-	})
-
-	app.TMI.OnUserPartMessage(func(message twitch.UserPartMessage) {
-		app.TCPServer.Broadcast(message.Raw + "\r\n")
-	})
-
 	app.TMI.OnUserStateMessage(func(message twitch.UserStateMessage) {
-		app.TCPServer.Broadcast(message.Raw + "\r\n")
-
 		if message.User.Name == app.Config.BotUsername {
+			// Twitch sends a USERSTATE for every message it accepted
+			app.Backoff.Reset(message.Channel)
+
+			// Only a USERSTATE answering a message has the ID Twitch gave it
+			if id, ok := message.Tags["id"]; ok && id != "" {
+				if echoed, ok := app.Sent.Answered(message.Channel); ok {
+					app.Lifecycle.Echoed(echoed, id)
+				}
+			}
+
 			channel := &dbmodels.ChannelTable{}
 			result := app.DB.
 				Where("name = ?", message.Channel).
@@ -137,7 +140,14 @@ func (app *Application) RunTMI(ctx context.Context) {
 				return
 			}
 
-			cs := app.Scheduler.ChannelSchedules[channel.Name]
+			cs, ok := app.Scheduler.Channel(channel.Name)
+			if !ok {
+				return
+			}
+
+			// Picks up changes to the interval without having to rejoin
+			app.Intervals.Set(channel.Name, channel.GetMessageInterval())
+			app.Scheduler.Reschedule(channel.Name)
 
 			isMod := userIsModerator(&message)
 			isVIP := userIsVIP(&message)
@@ -183,158 +193,140 @@ func (app *Application) RunTMI(ctx context.Context) {
 	}
 
 	for _, channel := range channels {
+		// Clients can already be joining channels
+		unlock := app.Membership.Lock(channel.Name)
+
+		app.Membership.Acquire(channel.Name, databaseHolder{})
+
 		app.TMI.Join(channel.Name)
+		app.Intervals.Set(channel.Name, channel.GetMessageInterval())
 		app.Scheduler.AddChannel(channel.Name, channel.GetBotPermission())
+
+		unlock()
 	}
 
-	err := app.TMI.Connect()
-	if err != nil {
+	if err := app.TMI.Connect(ctx); err != nil {
 		zap.S().Error(err)
-
-		return
 	}
-
-	<-ctx.Done()
 }
 
-func (app *Application) onTCPClient(c *tcp.Connection) {
-	zap.S().Info("Client connected")
+func (app *Application) RunTCP(ctx context.Context) {
+	firehose := app.Config.Services.Firehose
 
-	for {
-		msg, err := c.ReadString()
+	// A listener which is configured for TLS is never skipped, so a certificate which can't be loaded stops startup
+	var certs *tcp.CertificateLoader
+	if firehose.TLS.Port != 0 || firehose.WebSocket.TLS {
+		var err error
 
+		certs, err = app.loadCertificate(ctx)
 		if err != nil {
-			switch err {
-			case io.EOF, net.ErrClosed, err.(*net.OpError) /* wsarecv on winblows */ :
-				{
-					zap.S().Info("Client disconnected")
-					return
-				}
-			default:
-				{
-					zap.S().Error(err)
-					return
-				}
-
-			}
+			zap.S().Fatalf("Failed to load TLS certificate: %s", err)
 		}
+	}
 
-		/*
-			Due to mimicking a IRC server,
-			we have to manually handle certain commands like JOIN, PART and NICK
-			because the actual connection has been established to Twitch a long time ago.
-		*/
-		if strings.HasPrefix(msg, "JOIN") {
-			channels := strings.Split(removeTrailingNewline(strings.TrimPrefix(msg, "JOIN #")), ",")
-			for _, channel := range channels {
-				channel = strings.TrimPrefix(channel, "#")
-
-				zap.S().Infof("Received JOIN for %s", channel)
-
-				var perm dbmodels.BotPermmision
-				var dbChannel dbmodels.ChannelTable
-				result := app.DB.First(&dbChannel, "name = ?", channel)
-
-				if result.Error != nil {
-					perm = dbmodels.WritePermission
-				} else {
-					perm = dbChannel.GetBotPermission()
-				}
+	wg := sync.WaitGroup{}
 
-				app.TMI.Join(channel)
-				app.Scheduler.AddChannel(channel, perm)
+	if firehose.TLS.Port != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-				reply := app.formatTwitchMsg(fmt.Sprintf("JOIN #%s", channel))
+			addr := listenAddr(firehose.TLS.Host, firehose.TLS.Port)
 
-				c.WriteString(reply)
+			zap.S().Infof("Starting TLS server on %s", addr)
 
+			if err := app.TCPServer.StartTLS(ctx, addr, certs.TLSConfig(), app.onTCPClient); err != nil && ctx.Err() == nil {
+				zap.S().Error(err)
 			}
-		} else if strings.HasPrefix(msg, "PART") {
-			channels := strings.Split(removeTrailingNewline(strings.TrimPrefix(msg, "PART #")), ",")
-
-			for _, channel := range channels {
-				channel = strings.TrimPrefix(channel, "#")
-
-				zap.S().Infof("Received PART for %s", channel)
+		}()
+	}
 
-				_ = app.Scheduler.RemoveChannel(channel)
+	if firehose.WebSocket.Port != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-				app.TMI.Depart(channel)
+			var tlsConfig *tls.Config
+			if firehose.WebSocket.TLS {
+				tlsConfig = certs.TLSConfig()
+			}
 
-				reply := app.formatTwitchMsg(fmt.Sprintf("PART #%s", channel))
+			addr := listenAddr(firehose.WebSocket.Host, firehose.WebSocket.Port)
 
-				c.WriteString(reply)
+			zap.S().Infof("Starting WebSocket server on %s", addr)
 
+			if err := app.TCPServer.StartWebSocket(ctx, addr, tlsConfig, app.onTCPClient); err != nil && ctx.Err() == nil {
+				zap.S().Error(err)
 			}
-		} else if strings.HasPrefix(msg, "NICK") {
-			// Some clients expect a response for some commands
-			c.WriteString(app.createInitialJoinMessage())
+		}()
+	}
 
-		} else if strings.HasPrefix(msg, "CAP REQ") {
-			// Same with nick
+	addr := listenAddr(firehose.Host, firehose.Port)
 
-			c.WriteString(":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands twitch.tv/membership\r\n")
+	zap.S().Infof("Starting TCP server on %s", addr)
 
-		} else if strings.HasPrefix(msg, "PING") {
+	if err := app.TCPServer.Start(ctx, addr, app.onTCPClient); err != nil && ctx.Err() == nil {
+		zap.S().Error(err)
+	}
 
-			msgCorrId := strings.TrimPrefix(msg, "PING :")
+	wg.Wait()
+}
 
-			c.WriteString(fmt.Sprintf(":tmi.twitch.tv PONG tmi.twitch.tv :%s\r\n", msgCorrId))
+// Loads the TLS certificate, reloading it on SIGHUP, for example after it has been renewed
+func (app *Application) loadCertificate(ctx context.Context) (*tcp.CertificateLoader, error) {
+	conf := app.Config.Services.Firehose.TLS
 
-		} else if match := isReplyRegex.FindStringSubmatch(msg); match != nil {
-			replyParentMsgID := match[1]
-			channel := match[2]
-			message := removeTrailingNewline(match[3])
+	certs, err := tcp.NewCertificateLoader(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, err
+	}
 
-			zap.S().Infof("Replying in %s with %s", channel, message)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-			app.Scheduler.AddMessage(messagescheduler.MessageContext{
-				Channel: channel,
-				Message: message,
-				ReplyTo: &replyParentMsgID,
-			})
-		} else if match := extractPrivmsgRegex.FindStringSubmatch(msg); match != nil {
-			channel := match[1]
-			message := removeTrailingNewline(match[2])
+	go func() {
+		defer signal.Stop(hup)
 
-			zap.S().Infof("Sending %s to %s", message, channel)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := certs.Reload(); err != nil {
+					zap.S().Errorf("Failed to reload TLS certificate: %s", err)
+					continue
+				}
 
-			app.Scheduler.AddMessage(messagescheduler.MessageContext{
-				Channel: channel,
-				Message: message,
-			})
+				zap.S().Info("Reloaded TLS certificate")
+			}
 		}
-	}
-}
-
-func (app *Application) RunTCP(ctx context.Context) {
-	// Listen all interfaces
-	addr := fmt.Sprintf("0.0.0.0:%d", app.Config.Services.Firehose.Port)
+	}()
 
-	zap.S().Infof("Starting TCP server on %s", addr)
-
-	app.TCPServer.Start(ctx, addr, app.onTCPClient)
+	return certs, nil
 }
 
 func (app *Application) onScheduleMessage(ctx messagescheduler.MessageContext) {
-	lastMsg := app.LastMessage[ctx.Channel]
-
-	if lastMsg == ctx.Message {
-		if strings.Contains(ctx.Message, messageEvasionCharacter) {
-			ctx.Message = strings.ReplaceAll(ctx.Message, messageEvasionCharacter, "")
-
-		} else {
-			ctx.Message += fmt.Sprintf(" %s", messageEvasionCharacter)
-		}
-	}
-
-	app.LastMessage[ctx.Channel] = ctx.Message
+	ctx = app.Sent.Sent(ctx)
 
 	if ctx.ReplyTo != nil {
 		app.TMI.Reply(ctx.Channel, *ctx.ReplyTo, ctx.Message)
 	} else {
 		app.TMI.Say(ctx.Channel, ctx.Message)
 	}
+
+	app.Lifecycle.Track(ctx, StateSent, "")
+	app.feedback(ctx, noticeSent, "Your message was sent.")
+}
+
+// Sends what is left in the scheduler before TMI disconnects
+//
+// Messages which could not be sent are kept in redis and sent on the next start
+func (app *Application) shutdownScheduler() {
+	pending := app.Scheduler.Shutdown(schedulerShutdownTimeout)
+
+	if len(pending) > 0 {
+		zap.S().Infof("Keeping %d unsent messages until the next start", len(pending))
+	}
 }
 
 func main() {
@@ -343,6 +335,8 @@ func main() {
 		panic(err)
 	}
 
+	validateConfig(conf)
+
 	db, err := dbmodels.CreateGormPostgres(conf.SQL.Address)
 	if err != nil {
 		zap.S().Fatalf("failed to connect database: %v", err)
@@ -352,7 +346,30 @@ func main() {
 
 	done := applicationwrapper.NewWrapper(gCtx, cancel)
 
+	overflow, err := tcp.ParseOverflowPolicy(conf.Services.Firehose.ClientOverflowPolicy)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	channelQueue, err := queueLimit(conf.Services.Firehose.ChannelQueue)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
+	dropRestricted, err := messagescheduler.ParseRestrictedAction(conf.Services.Firehose.RestrictedRoomAction)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+
 	done.Execute(func(ctx context.Context) {
+		// TMI and the scheduler outlive ctx, so queued messages can still be sent while shutting down
+		sendCtx, stopSending := context.WithCancel(context.Background())
+		defer stopSending()
+
+		// Clients are disconnected after the scheduler has shut down, so departing their channels can't drop what it still has to send
+		clientCtx, stopClients := context.WithCancel(context.Background())
+		defer stopClients()
+
 		statusServer, err := status.NewServer(uint16(conf.Services.Firehose.HealthPort))
 		if err != nil {
 			zap.S().Fatal(err)
@@ -364,18 +381,54 @@ func main() {
 		}
 
 		app := Application{
-			TMI:          twitch.NewClient(conf.BotUsername, conf.Twitch.OAuth),
-			TCPServer:    tcp.NewServer(),
+			TMI: tmipool.New(tmipool.Options{
+				Username:              conf.BotUsername,
+				OAuth:                 conf.Twitch.OAuth,
+				ChannelsPerConnection: conf.Services.Firehose.ChannelsPerConnection,
+				Verified:              conf.Verified,
+			}),
+			TCPServer: tcp.NewServer(tcp.Options{
+				QueueSize:      conf.Services.Firehose.ClientQueueSize,
+				Overflow:       overflow,
+				MaxConnections: conf.Services.Firehose.ClientMaxConnections,
+			}),
 			HealthServer: statusServer,
 			DB:           db,
 			Redis:        redisInst,
 			Config:       conf,
-			Scheduler:    messagescheduler.NewMessageScheduler(ctx),
-			LastMessage:  make(map[string]string),
+			Scheduler:    messagescheduler.NewMessageScheduler(sendCtx),
+			Intervals:    messagescheduler.NewIntervalPolicy(),
+			RoomStates:   messagescheduler.NewRoomStates(dropRestricted),
+			SlowMode:     messagescheduler.NewSlowModePolicy(),
+			Backoff:      messagescheduler.NewBackoffPolicy(),
+			Membership:   NewMembership(),
+			State:        NewStateCache(),
+			Sent:         NewSentMessages(),
+			Lifecycle:    NewLifecycle(sendCtx, redisInst),
 		}
 
-		if conf.Verified {
-			app.TMI.SetJoinRateLimiter(twitch.CreateVerifiedRateLimiter())
+		app.HealthServer.Handle("/clients", app.authenticated(app.clientsRoute))
+		app.HealthServer.Handle("/clients/kick", app.authenticated(app.kickRoute))
+		app.HealthServer.Handle("/scheduled", app.authenticated(app.scheduledRoute))
+		app.HealthServer.Handle("/messages", app.authenticated(app.messagesRoute))
+		app.HealthServer.Handle("/ratelimit", app.authenticated(app.rateLimitRoute))
+
+		app.Scheduler.SetOnMessage(app.onScheduleMessage)
+		app.Scheduler.SetOnDrop(app.onScheduleDrop)
+		app.Scheduler.SetLimiter(messagescheduler.NewGlobalLimiter(conf.Verified))
+		app.Scheduler.SetQueueLimit(channelQueue)
+		app.Scheduler.SetRatePolicy(messagescheduler.Policies{
+			messagescheduler.PermissionPolicy{},
+			app.Intervals,
+			app.SlowMode,
+			app.Backoff,
+		})
+		app.Scheduler.SetGate(app.RoomStates)
+		app.Scheduler.SetOnHold(app.onScheduleHold)
+		app.Scheduler.SetStore(messagescheduler.NewRedisStore(redisInst))
+
+		if err := app.Scheduler.Restore(); err != nil {
+			zap.S().Errorw("Failed to restore queued messages", "error", err)
 		}
 
 		wg := sync.WaitGroup{}
@@ -384,7 +437,7 @@ func main() {
 		go func() {
 			defer wg.Done()
 
-			app.RunTMI(ctx)
+			app.RunTMI(sendCtx)
 		}()
 
 		wg.Add(1)
@@ -395,7 +448,7 @@ func main() {
 		go func() {
 			defer wg.Done()
 
-			app.RunTCP(ctx)
+			app.RunTCP(clientCtx)
 		}()
 
 		wg.Add(1)
@@ -407,18 +460,61 @@ func main() {
 			app.HealthServer.Start(ctx)
 		}()
 
-		app.Scheduler.SetOnMessage(app.onScheduleMessage)
 		app.Scheduler.Run()
 
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-ctx.Done()
+
+			app.shutdownScheduler()
+			stopClients()
+			stopSending()
+		}()
+
 		wg.Wait()
 	})
 }
 
-func removeTrailingNewline(s string) string {
-	s = strings.ReplaceAll(s, "\n", "")
-	s = strings.ReplaceAll(s, "\r", "")
+// Formats a listen address, listening on all interfaces by default
+func listenAddr(host string, port int) string {
+	if host == "" {
+		host = "0.0.0.0"
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Converts a queue limit from the config
+func queueLimit(limit config.QueueLimit) (messagescheduler.QueueLimit, error) {
+	policy, err := messagescheduler.ParseQueuePolicy(limit.Policy)
+	if err != nil {
+		return messagescheduler.QueueLimit{}, err
+	}
+
+	return messagescheduler.QueueLimit{
+		Size:   limit.Size,
+		Policy: policy,
+	}, nil
+}
+
+func validateConfig(conf *config.Config) {
+	firehose := conf.Services.Firehose
+
+	if firehose.Token == "" && len(firehose.Clients) == 0 {
+		zap.S().Fatal("Firehose requires a Token or at least one client in Clients")
+	}
 
-	return s
+	if (firehose.TLS.Port != 0 || firehose.WebSocket.TLS) && (firehose.TLS.Cert == "" || firehose.TLS.Key == "") {
+		zap.S().Fatal("Firehose TLS requires both Cert and Key")
+	}
+
+	for _, client := range firehose.Clients {
+		if client.Token == "" {
+			zap.S().Fatalf("Firehose client %s is missing a token", client.Name)
+		}
+	}
 }
 
 func userIsBroadcaster(msg *twitch.UserStateMessage) bool {
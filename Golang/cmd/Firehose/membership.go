@@ -0,0 +1,145 @@
+package main
+
+import "sync"
+
+// databaseHolder holds a reference to every channel stored in bot.channels
+type databaseHolder struct{}
+
+// Membership reference counts who needs an upstream channel to stay joined
+//
+// A holder is either a client connection or the databaseHolder
+type Membership struct {
+	mu      sync.Mutex
+	holders map[string]map[interface{}]struct{}
+	// Held while a channel is joined or departed upstream, see Lock
+	locks map[string]*channelLock
+}
+
+type channelLock struct {
+	mu sync.Mutex
+	// How many are holding or waiting for the lock
+	refs int
+}
+
+func NewMembership() *Membership {
+	return &Membership{
+		holders: make(map[string]map[interface{}]struct{}),
+		locks:   make(map[string]*channelLock),
+	}
+}
+
+// Lock serializes changes to a channel, returning the function which unlocks it
+//
+// Acquiring and joining, or releasing and departing, has to happen while the lock is held,
+// otherwise a channel acquired between a release and its depart would be left upstream while it's held
+func (m *Membership) Lock(channel string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[channel]
+	if !ok {
+		l = &channelLock{}
+		m.locks[channel] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, channel)
+		}
+	}
+}
+
+// Acquire adds a reference to channel for holder
+//
+// Returns true if this is the first reference to the channel
+func (m *Membership) Acquire(channel string, holder interface{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	holders, ok := m.holders[channel]
+	if !ok {
+		holders = make(map[interface{}]struct{})
+		m.holders[channel] = holders
+	}
+
+	holders[holder] = struct{}{}
+
+	return !ok
+}
+
+// AcquireAll adds a reference to channel for every holder
+//
+// Returns true if nobody held the channel before
+func (m *Membership) AcquireAll(channel string, holders ...interface{}) bool {
+	first := false
+
+	for _, holder := range holders {
+		if m.Acquire(channel, holder) {
+			first = true
+		}
+	}
+
+	return first
+}
+
+// Release removes the reference holder has to channel
+//
+// Returns true if nobody holds the channel anymore
+func (m *Membership) Release(channel string, holder interface{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.release(channel, holder)
+}
+
+// Channels returns every channel holder holds
+func (m *Membership) Channels(holder interface{}) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	channels := make([]string, 0)
+
+	for channel, holders := range m.holders {
+		if _, ok := holders[holder]; ok {
+			channels = append(channels, channel)
+		}
+	}
+
+	return channels
+}
+
+// OnlyHeldBy checks if holder is the last one holding channel
+func (m *Membership) OnlyHeldBy(channel string, holder interface{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	holders := m.holders[channel]
+	_, ok := holders[holder]
+
+	return ok && len(holders) == 1
+}
+
+func (m *Membership) release(channel string, holder interface{}) bool {
+	holders, ok := m.holders[channel]
+	if !ok {
+		return false
+	}
+
+	delete(holders, holder)
+
+	if len(holders) > 0 {
+		return false
+	}
+
+	delete(m.holders, channel)
+
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireAllDatabaseChannel(t *testing.T) {
+	m := NewMembership()
+	client := &struct{ name string }{"client"}
+
+	// A channel in bot.channels the bot joined after startup, nobody holds it yet
+	if !m.AcquireAll("forsen", client, databaseHolder{}) {
+		t.Fatal("Expected the first reference to a database channel to join it")
+	}
+
+	other := &struct{ name string }{"other"}
+	if m.AcquireAll("forsen", other, databaseHolder{}) {
+		t.Error("Expected a channel which is already held not to be joined again")
+	}
+
+	if m.Release("forsen", client) || m.Release("forsen", other) {
+		t.Error("Expected the database to still hold the channel")
+	}
+
+	if !m.OnlyHeldBy("forsen", databaseHolder{}) {
+		t.Error("Expected only the database to hold the channel")
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	m := NewMembership()
+	a := &struct{ name string }{"a"}
+	b := &struct{ name string }{"b"}
+
+	if !m.Acquire("forsen", a) {
+		t.Error("Expected the first reference")
+	}
+
+	if m.Acquire("forsen", b) {
+		t.Error("Expected a second reference not to be the first")
+	}
+
+	if m.Release("forsen", a) {
+		t.Error("Expected b to still hold the channel")
+	}
+
+	if channels := m.Channels(b); len(channels) != 1 || channels[0] != "forsen" {
+		t.Errorf("Expected b to hold forsen, got %v", channels)
+	}
+
+	if !m.Release("forsen", b) {
+		t.Error("Expected forsen to be emptied")
+	}
+
+	if channels := m.Channels(b); len(channels) != 0 {
+		t.Errorf("Expected b to hold nothing, got %v", channels)
+	}
+}
+
+func TestLock(t *testing.T) {
+	m := NewMembership()
+
+	unlock := m.Lock("forsen")
+
+	// Other channels are not held up
+	done := make(chan struct{})
+	go func() {
+		m.Lock("pajlada")()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected another channel to be lockable")
+	}
+
+	// A join can't run between a release and its depart
+	locked := make(chan struct{})
+	go func() {
+		defer m.Lock("forsen")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Expected the channel to stay locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the channel to be locked once unlocked")
+	}
+
+	waitFor := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		n := len(m.locks)
+		m.mu.Unlock()
+
+		if n == 0 {
+			break
+		}
+
+		if time.Now().After(waitFor) {
+			t.Fatalf("Expected unused locks to be removed, %d left", n)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
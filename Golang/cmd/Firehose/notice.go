@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+	"github.com/gempir/go-twitch-irc/v4"
+	"go.uber.org/zap"
+)
+
+// msg-id values of NOTICEs Twitch sends when it refuses to send a message
+const (
+	msgRatelimit             = "msg_ratelimit"
+	msgDuplicate             = "msg_duplicate"
+	msgBanned                = "msg_banned"
+	msgTimedout              = "msg_timedout"
+	msgChannelSuspended      = "msg_channel_suspended"
+	msgRequiresVerifiedPhone = "msg_requires_verified_phone_number"
+)
+
+// Room modes Twitch refused to send a message because of, by msg-id
+var restrictedModes = map[string]error{
+	"msg_emoteonly":              messagescheduler.ErrEmoteOnly,
+	"msg_followersonly":          messagescheduler.ErrFollowersOnly,
+	"msg_followersonly_followed": messagescheduler.ErrFollowersOnly,
+	"msg_followersonly_zero":     messagescheduler.ErrFollowersOnly,
+	"msg_subsonly":               messagescheduler.ErrSubsOnly,
+}
+
+// "You are timed out for 599 more seconds."
+var timeoutPattern = regexp.MustCompile(`(\d+) more seconds?`)
+
+// Reacts to Twitch refusing to send a message to a channel
+//
+// The NOTICE doesn't say which message was refused, see SentMessages.Answered
+func (app *Application) onNotice(ctx context.Context, message twitch.NoticeMessage) {
+	zap.S().Debug(message.Raw)
+
+	channel := message.Channel
+
+	switch message.MsgID {
+	case msgRatelimit:
+		backoff := app.Backoff.Backoff(channel)
+		app.Scheduler.Reschedule(channel)
+
+		zap.S().Warnw("Sending too quickly, backing off", "channel", channel, "backoff", backoff)
+
+		app.refused(channel, message.MsgID, noticeRatelimited, "Twitch refused your message because messages are sent too quickly.")
+		return
+
+	case msgDuplicate:
+		retry, again, ok := app.Sent.Duplicate(channel)
+		if !ok {
+			return
+		}
+
+		if !again {
+			app.Lifecycle.Track(retry, StateRejected, message.MsgID)
+			app.feedback(retry, noticeRejected, "Twitch refused your message as a duplicate of the previous one.")
+			return
+		}
+
+		// Queued again as is, it is changed to evade the duplicate check when it is sent
+		retry.Priority = messagescheduler.PriorityHigh
+		if err := app.Scheduler.AddMessage(retry); err != nil {
+			zap.S().Warnw("Failed to retry duplicate message", "channel", channel, "error", err)
+
+			app.Lifecycle.Track(retry, StateRejected, message.MsgID)
+			app.feedback(retry, noticeRejected, "Twitch refused your message as a duplicate of the previous one.")
+			return
+		}
+
+		app.Lifecycle.Track(retry, StateQueued, message.MsgID)
+		app.feedback(retry, noticeRetried, "Twitch refused your message as a duplicate, it will be sent again.")
+		return
+
+	case msgTimedout:
+		timeout, ok := parseTimeout(message.Message)
+		if !ok {
+			zap.S().Warnw("Timed out for an unknown duration", "channel", channel, "notice", message.Message)
+			break
+		}
+
+		app.Backoff.Hold(channel, timeout)
+		app.Scheduler.Reschedule(channel)
+
+		zap.S().Warnw("Timed out, holding messages", "channel", channel, "timeout", timeout)
+
+	case msgRequiresVerifiedPhone:
+		// Only the message is refused, the account needs a verified phone number to speak in this channel
+		zap.S().Warnw("Verified phone number required", "channel", channel)
+
+	case msgBanned, msgChannelSuspended:
+		// Also the answer to joining a suspended channel, which isn't about any message
+		if message.MsgID == msgChannelSuspended && !app.Sent.Waiting(channel) {
+			zap.S().Warnw("Joined a suspended channel", "channel", channel)
+			return
+		}
+
+		row := &dbmodels.ChannelTable{}
+		result := app.DB.
+			Where("name = ?", channel).
+			First(row)
+
+		if result.Error != nil {
+			zap.S().Errorf("Failed to find channel %s: %s", channel, result.Error)
+			return
+		}
+
+		zap.S().Warnw("Not allowed to speak, switching to read", "channel", channel, "reason", message.MsgID)
+
+		app.setPermission(ctx, row, dbmodels.ReadPermission)
+
+	default:
+		mode, ok := restrictedModes[message.MsgID]
+		if !ok {
+			return
+		}
+
+		// Only now is it known the bot doesn't follow or isn't subscribed, so the next messages are held or dropped
+		app.RoomStates.Refused(channel, mode)
+		app.Scheduler.Reschedule(channel)
+
+		zap.S().Warnw("Restricted by room mode", "channel", channel, "mode", mode)
+	}
+
+	app.refused(channel, message.MsgID, noticeRejected, "Twitch refused your message: "+message.Message)
+}
+
+// Marks the message Twitch refused as rejected, for reason, and tells the client which sent it
+//
+// Nothing is marked if it isn't known which message was refused
+func (app *Application) refused(channel, reason, msgID, text string) {
+	if refused, ok := app.Sent.Answered(channel); ok {
+		app.Lifecycle.Track(refused, StateRejected, reason)
+		app.feedback(refused, msgID, text)
+	}
+}
+
+// Reads how long a timeout lasts from the text of a msg_timedout NOTICE
+func parseTimeout(text string) (time.Duration, bool) {
+	match := timeoutPattern.FindStringSubmatch(text)
+	if match == nil {
+		return 0, false
+	}
+
+	seconds, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/redis"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+
+	"go.uber.org/zap"
+)
+
+// Only lets requests with the configured bearer token through, every request is refused if no token is configured
+func (app *Application) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := app.Config.Services.Firehose.APIToken
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		zap.S().Errorw("Failed to marshal response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if _, err := w.Write(body); err != nil {
+		zap.S().Errorw("Failed to write response", "error", err)
+	}
+}
+
+// Lists every connected client, including how many messages they have had dropped
+func (app *Application) clientsRoute(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.TCPServer.Connections())
+}
+
+// Disconnects a client by its ID, POST /clients/kick?id=<id>&reason=<reason>
+func (app *Application) kickRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Kicked"
+	}
+
+	if err := app.TCPServer.Kick(id, reason); err != nil {
+		if errors.Is(err, tcp.ErrConnectionNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		zap.S().Errorw("Failed to kick client", "id", id, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	zap.S().Infow("Kicked client", "id", id, "reason", reason)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Shows how many messages can be sent before hitting Twitch's account wide limit
+func (app *Application) rateLimitRoute(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.Scheduler.Limiter().Remaining())
+}
+
+// Lists scheduled messages with GET, DELETE /scheduled?id=<id> cancels a message
+func (app *Application) scheduledRoute(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, app.Scheduler.Scheduled())
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		msg, err := app.Scheduler.Cancel(id)
+		if errors.Is(err, messagescheduler.ErrMessageNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		zap.S().Infow("Cancelled message", "id", id, "channel", msg.Channel)
+
+		app.Lifecycle.Track(msg, StateDropped, "cancelled")
+
+		writeJSON(w, http.StatusOK, msg)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Looks up what happened to a message, GET /messages?id=<id>
+func (app *Application) messagesRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	record, err := app.Lifecycle.Get(r.Context(), id)
+	if errors.Is(err, redis.Nil) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		zap.S().Errorw("Failed to look up message", "id", id, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, record)
+}
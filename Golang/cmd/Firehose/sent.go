@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+)
+
+// Twitch answers a message within a second or two, messages which got no answer by then are not waited on
+const answerTimeout = 10 * time.Second
+
+type sentMessage struct {
+	ctx messagescheduler.MessageContext
+	// Sent again after Twitch refused it as a duplicate
+	retry bool
+	at    time.Time
+}
+
+// SentMessages remembers the last message sent to every channel, and the messages Twitch has yet to answer
+//
+// Twitch refuses a message identical to the previous one, so it is used to tell when to evade that and what to retry
+type SentMessages struct {
+	mu       sync.Mutex
+	messages map[string]sentMessage
+	// IDs of messages queued again by Retry
+	retries map[string]struct{}
+	// Messages waiting for a USERSTATE or NOTICE, oldest first
+	unanswered map[string][]sentMessage
+}
+
+func NewSentMessages() *SentMessages {
+	return &SentMessages{
+		messages:   make(map[string]sentMessage),
+		retries:    make(map[string]struct{}),
+		unanswered: make(map[string][]sentMessage),
+	}
+}
+
+// Sent records a message about to be sent, returning it changed so it's not identical to the previous one
+func (s *SentMessages) Sent(ctx messagescheduler.MessageContext) messagescheduler.MessageContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messages[ctx.Channel].ctx.Message == ctx.Message {
+		ctx.Message = evade(ctx.Message)
+	}
+
+	_, retry := s.retries[ctx.ID]
+	delete(s.retries, ctx.ID)
+
+	sent := sentMessage{ctx: ctx, retry: retry, at: time.Now()}
+
+	s.messages[ctx.Channel] = sent
+	s.unanswered[ctx.Channel] = append(s.prune(ctx.Channel, sent.at), sent)
+
+	return ctx
+}
+
+// Answered returns the message a USERSTATE or NOTICE answers
+//
+// Neither says which message it answers, so it's only known if a single message is waiting for an answer.
+// Otherwise false is returned and every waiting message is given up on, so the next answer can be matched again.
+func (s *SentMessages) Answered(channel string) (messagescheduler.MessageContext, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent, ok := s.answered(channel)
+
+	return sent.ctx, ok
+}
+
+// Waiting reports whether a message sent to channel is waiting for an answer
+func (s *SentMessages) Waiting(channel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.prune(channel, time.Now())) > 0
+}
+
+// Duplicate returns the message Twitch refused as a duplicate and whether it can be sent again
+//
+// Like Answered, ok is false if it isn't known which message was refused. A message is only retried once.
+func (s *SentMessages) Duplicate(channel string) (ctx messagescheduler.MessageContext, retry bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent, ok := s.answered(channel)
+	if !ok || sent.retry {
+		return sent.ctx, false, ok
+	}
+
+	s.retries[sent.ctx.ID] = struct{}{}
+
+	return sent.ctx, true, true
+}
+
+// s.mu has to be held
+func (s *SentMessages) answered(channel string) (sentMessage, bool) {
+	unanswered := s.prune(channel, time.Now())
+	delete(s.unanswered, channel)
+
+	if len(unanswered) != 1 {
+		return sentMessage{}, false
+	}
+
+	return unanswered[0], true
+}
+
+// Removes the messages which have waited too long for an answer, s.mu has to be held
+func (s *SentMessages) prune(channel string, now time.Time) []sentMessage {
+	unanswered := s.unanswered[channel]
+
+	for len(unanswered) > 0 && now.Sub(unanswered[0].at) > answerTimeout {
+		unanswered = unanswered[1:]
+	}
+
+	return unanswered
+}
+
+func (s *SentMessages) Forget(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.messages, channel)
+	delete(s.unanswered, channel)
+}
+
+// Adds or removes the evasion character, whichever makes the message differ from the original
+func evade(message string) string {
+	if strings.Contains(message, messageEvasionCharacter) {
+		return strings.ReplaceAll(message, messageEvasionCharacter, "")
+	}
+
+	return message + " " + messageEvasionCharacter
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	messagescheduler "github.com/JoachimFlottorp/Melonbot/Golang/internal/message_scheduler"
+)
+
+func TestAnswered(t *testing.T) {
+	s := NewSentMessages()
+
+	if _, ok := s.Answered("forsen"); ok {
+		t.Error("Expected nothing to be answered before a message is sent")
+	}
+
+	s.Sent(messagescheduler.MessageContext{ID: "1", Channel: "forsen", Message: "a"})
+
+	if answered, ok := s.Answered("forsen"); !ok || answered.ID != "1" {
+		t.Errorf("Expected the only message to be answered, got %q %t", answered.ID, ok)
+	}
+
+	// Each message is only answered once
+	if _, ok := s.Answered("forsen"); ok {
+		t.Error("Expected the message to be answered only once")
+	}
+
+	s.Sent(messagescheduler.MessageContext{ID: "2", Channel: "forsen", Message: "b"})
+	s.Sent(messagescheduler.MessageContext{ID: "3", Channel: "forsen", Message: "c"})
+	s.Sent(messagescheduler.MessageContext{ID: "4", Channel: "pajlada", Message: "d"})
+
+	// Two messages are waiting, so the answer can't be matched to either
+	if answered, ok := s.Answered("forsen"); ok {
+		t.Errorf("Expected an ambiguous answer not to be matched, got %q", answered.ID)
+	}
+
+	// Both are given up on, so the next message can be matched again
+	s.Sent(messagescheduler.MessageContext{ID: "5", Channel: "forsen", Message: "e"})
+
+	if answered, ok := s.Answered("forsen"); !ok || answered.ID != "5" {
+		t.Errorf("Expected the new message to be answered, got %q %t", answered.ID, ok)
+	}
+
+	if answered, ok := s.Answered("pajlada"); !ok || answered.ID != "4" {
+		t.Errorf("Expected channels to be matched separately, got %q %t", answered.ID, ok)
+	}
+}
+
+func TestAnsweredTimeout(t *testing.T) {
+	s := NewSentMessages()
+
+	s.Sent(messagescheduler.MessageContext{ID: "1", Channel: "forsen", Message: "a"})
+
+	// Twitch never answered the first message
+	s.mu.Lock()
+	s.unanswered["forsen"][0].at = time.Now().Add(-2 * answerTimeout)
+	s.mu.Unlock()
+
+	s.Sent(messagescheduler.MessageContext{ID: "2", Channel: "forsen", Message: "b"})
+
+	if answered, ok := s.Answered("forsen"); !ok || answered.ID != "2" {
+		t.Errorf("Expected the message which wasn't given up on to be answered, got %q %t", answered.ID, ok)
+	}
+}
+
+func TestWaiting(t *testing.T) {
+	s := NewSentMessages()
+
+	if s.Waiting("forsen") {
+		t.Error("Expected no message to be waiting before one is sent")
+	}
+
+	s.Sent(messagescheduler.MessageContext{ID: "1", Channel: "forsen", Message: "a"})
+
+	if !s.Waiting("forsen") {
+		t.Error("Expected the sent message to be waiting")
+	}
+
+	s.Answered("forsen")
+
+	if s.Waiting("forsen") {
+		t.Error("Expected no message to be waiting once it was answered")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	s := NewSentMessages()
+
+	s.Sent(messagescheduler.MessageContext{ID: "1", Channel: "forsen", Message: "a"})
+
+	duplicate, retry, ok := s.Duplicate("forsen")
+	if !ok || !retry || duplicate.ID != "1" {
+		t.Fatalf("Expected the message to be retried, got %q %t %t", duplicate.ID, retry, ok)
+	}
+
+	// Refused again after being sent again
+	s.Sent(duplicate)
+
+	if _, retry, ok := s.Duplicate("forsen"); !ok || retry {
+		t.Errorf("Expected a message to be retried only once, got %t %t", retry, ok)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/config"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+)
+
+// Session is the state Firehose keeps for a single client connection
+type Session struct {
+	Conn tcp.Conn
+	// nil until the client has authenticated with PASS
+	Client *config.FirehoseClient
+}
+
+func NewSession(c tcp.Conn) *Session {
+	return &Session{
+		Conn: c,
+	}
+}
+
+// Authenticate checks a PASS token against the configured clients
+func (s *Session) Authenticate(conf *config.Config, token string) bool {
+	token = strings.TrimPrefix(token, "oauth:")
+	if token == "" {
+		return false
+	}
+
+	firehose := conf.Services.Firehose
+
+	clients := make([]config.FirehoseClient, 0, len(firehose.Clients)+1)
+	if firehose.Token != "" {
+		clients = append(clients, config.FirehoseClient{
+			Name:       conf.BotUsername,
+			Token:      firehose.Token,
+			MessageTTL: firehose.MessageTTL,
+		})
+	}
+	clients = append(clients, firehose.Clients...)
+
+	for i := range clients {
+		if subtle.ConstantTimeCompare([]byte(clients[i].Token), []byte(token)) != 1 {
+			continue
+		}
+
+		s.Client = &clients[i]
+		s.Conn.SetAuthenticated(true)
+
+		// Restricted clients only get the channels they are allowed in
+		if s.IsRestricted() {
+			s.Conn.SetRestricted(true)
+			s.Conn.RemoveCapability(tcp.CapabilityFirehose)
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// IsAuthenticated checks if the client has sent a valid PASS
+func (s *Session) IsAuthenticated() bool {
+	return s.Client != nil
+}
+
+// IsRestricted checks if the client is limited to a set of channels
+func (s *Session) IsRestricted() bool {
+	return s.Client != nil && len(s.Client.Channels) > 0
+}
+
+// CanJoin checks if the client is allowed to join a channel
+func (s *Session) CanJoin(channel string) bool {
+	if s.Client == nil {
+		return false
+	}
+
+	if !s.IsRestricted() {
+		return true
+	}
+
+	for _, allowed := range s.Client.Channels {
+		if strings.EqualFold(strings.TrimPrefix(allowed, "#"), channel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanSend checks if the client is allowed to send a message to a channel
+func (s *Session) CanSend(channel string) bool {
+	return s.Client != nil && !s.Client.ReadOnly && s.CanJoin(channel)
+}
+
+// CanRequest checks if every capability in a CAP REQ is supported and allowed for the client
+func (s *Session) CanRequest(capabilities []string) bool {
+	if len(capabilities) == 0 {
+		return false
+	}
+
+	for _, capability := range capabilities {
+		if _, ok := supportedCapabilities[capability]; !ok {
+			return false
+		}
+
+		if capability == tcp.CapabilityFirehose && s.IsRestricted() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MessageTTL is how long a message from the client may be queued, 0 if it never expires
+func (s *Session) MessageTTL() time.Duration {
+	if s.Client == nil {
+		return 0
+	}
+
+	return time.Duration(s.Client.MessageTTL) * time.Millisecond
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/config"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+)
+
+func TestCanRequest(t *testing.T) {
+	unrestricted := &Session{Client: &config.FirehoseClient{Name: "bot"}}
+	restricted := &Session{Client: &config.FirehoseClient{Name: "logger", Channels: []string{"forsen"}}}
+
+	tests := []struct {
+		name         string
+		session      *Session
+		capabilities []string
+		allowed      bool
+	}{
+		{"supported", unrestricted, []string{capabilityTags, capabilityCommands}, true},
+		{"firehose", unrestricted, []string{capabilityTags, tcp.CapabilityFirehose}, true},
+		{"unknown", unrestricted, []string{capabilityTags, "foo/bar"}, false},
+		{"restricted firehose", restricted, []string{capabilityTags, tcp.CapabilityFirehose}, false},
+		{"restricted supported", restricted, []string{capabilityMembership}, true},
+		{"empty", unrestricted, []string{}, false},
+	}
+
+	for _, test := range tests {
+		if allowed := test.session.CanRequest(test.capabilities); allowed != test.allowed {
+			t.Errorf("%s: expected %t, got %t", test.name, test.allowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/irc"
+)
+
+// StateCache keeps the latest state messages received upstream,
+// so they can be replayed to clients joining after the upstream connection already did.
+type StateCache struct {
+	mu              sync.RWMutex
+	roomState       map[string]*irc.Message
+	userState       map[string]*irc.Message
+	globalUserState *irc.Message
+}
+
+func NewStateCache() *StateCache {
+	return &StateCache{
+		roomState: make(map[string]*irc.Message),
+		userState: make(map[string]*irc.Message),
+	}
+}
+
+// Update stores msg if it is a ROOMSTATE, USERSTATE or GLOBALUSERSTATE
+func (s *StateCache) Update(msg *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch msg.Command {
+	case "ROOMSTATE":
+		channel := msg.Channel()
+
+		// After the initial ROOMSTATE twitch only sends the tags which changed
+		current, ok := s.roomState[channel]
+		if !ok {
+			s.roomState[channel] = msg
+			return
+		}
+
+		merged := *current
+		merged.Tags = make(map[string]string, len(current.Tags))
+		for key, value := range current.Tags {
+			merged.Tags[key] = value
+		}
+		for key, value := range msg.Tags {
+			merged.Tags[key] = value
+		}
+
+		s.roomState[channel] = &merged
+	case "USERSTATE":
+		state := *msg
+		state.Tags = make(map[string]string, len(msg.Tags))
+		for key, value := range msg.Tags {
+			// Only belong to the message the USERSTATE was a response to
+			if key == "id" || key == "client-nonce" {
+				continue
+			}
+
+			state.Tags[key] = value
+		}
+
+		s.userState[msg.Channel()] = &state
+	case "GLOBALUSERSTATE":
+		s.globalUserState = msg
+	}
+}
+
+// Forget removes the state of a channel which was departed
+func (s *StateCache) Forget(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.roomState, channel)
+	delete(s.userState, channel)
+}
+
+// Channel returns the USERSTATE and ROOMSTATE of a channel in the order TMI sends them after a JOIN
+func (s *StateCache) Channel(channel string) []*irc.Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make([]*irc.Message, 0, 2)
+
+	if state, ok := s.userState[channel]; ok {
+		states = append(states, state)
+	}
+
+	if state, ok := s.roomState[channel]; ok {
+		states = append(states, state)
+	}
+
+	return states
+}
+
+// GlobalUserState returns the last GLOBALUSERSTATE, or nil if none has been received
+func (s *StateCache) GlobalUserState() *irc.Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.globalUserState
+}
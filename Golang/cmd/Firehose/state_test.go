@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/irc"
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/tcp"
+)
+
+func mustParse(t *testing.T, raw string) *irc.Message {
+	t.Helper()
+
+	msg, err := irc.Parse(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %s", raw, err)
+	}
+
+	return msg
+}
+
+func TestStateCacheMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		updates  []string
+		command  string
+		expected map[string]string
+		// Tags which should not be cached
+		missing []string
+	}{
+		{
+			name: "roomstate partial update",
+			updates: []string{
+				"@emote-only=0;followers-only=-1;r9k=0;room-id=1;slow=0;subs-only=0 :tmi.twitch.tv ROOMSTATE #forsen",
+				"@room-id=1;slow=10 :tmi.twitch.tv ROOMSTATE #forsen",
+			},
+			command:  "ROOMSTATE",
+			expected: map[string]string{"emote-only": "0", "followers-only": "-1", "slow": "10", "subs-only": "0"},
+		},
+		{
+			name: "roomstate later update wins",
+			updates: []string{
+				"@emote-only=0;room-id=1;subs-only=0 :tmi.twitch.tv ROOMSTATE #forsen",
+				"@room-id=1;subs-only=1 :tmi.twitch.tv ROOMSTATE #forsen",
+				"@emote-only=1;room-id=1 :tmi.twitch.tv ROOMSTATE #forsen",
+			},
+			command:  "ROOMSTATE",
+			expected: map[string]string{"emote-only": "1", "subs-only": "1"},
+		},
+		{
+			name: "userstate replaces and drops message tags",
+			updates: []string{
+				"@badges=;color=#FF0000;mod=0 :tmi.twitch.tv USERSTATE #forsen",
+				"@badges=moderator/1;color=#FF0000;id=abc;client-nonce=123;mod=1 :tmi.twitch.tv USERSTATE #forsen",
+			},
+			command:  "USERSTATE",
+			expected: map[string]string{"badges": "moderator/1", "mod": "1"},
+			missing:  []string{"id", "client-nonce"},
+		},
+	}
+
+	for _, test := range tests {
+		s := NewStateCache()
+
+		for _, update := range test.updates {
+			s.Update(mustParse(t, update))
+		}
+
+		var state *irc.Message
+		for _, msg := range s.Channel("forsen") {
+			if msg.Command == test.command {
+				state = msg
+			}
+		}
+
+		if state == nil {
+			t.Errorf("%s: no %s cached", test.name, test.command)
+			continue
+		}
+
+		for key, value := range test.expected {
+			if state.Tags[key] != value {
+				t.Errorf("%s: expected %s=%s, got %q", test.name, key, value, state.Tags[key])
+			}
+		}
+
+		for _, key := range test.missing {
+			if _, ok := state.Tags[key]; ok {
+				t.Errorf("%s: expected %s not to be cached", test.name, key)
+			}
+		}
+	}
+}
+
+func TestStateCacheForget(t *testing.T) {
+	s := NewStateCache()
+
+	s.Update(mustParse(t, "@emote-only=0;room-id=1 :tmi.twitch.tv ROOMSTATE #forsen"))
+	s.Update(mustParse(t, "@mod=0 :tmi.twitch.tv USERSTATE #forsen"))
+	s.Update(mustParse(t, "@emote-only=0;room-id=2 :tmi.twitch.tv ROOMSTATE #pajlada"))
+	s.Update(mustParse(t, "@user-id=3 :tmi.twitch.tv GLOBALUSERSTATE"))
+
+	// Upstream departed forsen
+	s.Forget("forsen")
+
+	if states := s.Channel("forsen"); len(states) != 0 {
+		t.Errorf("Expected forsen to be forgotten, got %d states", len(states))
+	}
+
+	if states := s.Channel("pajlada"); len(states) != 1 {
+		t.Errorf("Expected pajlada to be kept, got %d states", len(states))
+	}
+
+	if s.GlobalUserState() == nil {
+		t.Error("Expected GLOBALUSERSTATE to be kept")
+	}
+}
+
+func TestReplayOrder(t *testing.T) {
+	s := NewStateCache()
+
+	// Received in the opposite order of how TMI sends them after a JOIN
+	s.Update(mustParse(t, "@emote-only=0;room-id=1 :tmi.twitch.tv ROOMSTATE #forsen"))
+	s.Update(mustParse(t, "@mod=0 :tmi.twitch.tv USERSTATE #forsen"))
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := tcp.NewConnection(1, server, tcp.Options{})
+	defer c.Close()
+
+	c.AddCapability(capabilityTags)
+	c.AddCapability(capabilityCommands)
+
+	app := &Application{}
+	app.replay(c, s.Channel("forsen")...)
+
+	r := bufio.NewReader(client)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+	for _, expected := range []string{"USERSTATE", "ROOMSTATE"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := mustParse(t, strings.TrimRight(line, "\r\n"))
+		if msg.Command != expected {
+			t.Errorf("Expected %s, got %s", expected, msg.Command)
+		}
+	}
+}
+
+func TestReplayWithoutCommands(t *testing.T) {
+	s := NewStateCache()
+	s.Update(mustParse(t, "@mod=0 :tmi.twitch.tv USERSTATE #forsen"))
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := tcp.NewConnection(1, server, tcp.Options{})
+	defer c.Close()
+
+	app := &Application{}
+	app.replay(c, s.Channel("forsen")...)
+
+	// Nothing is queued for a client without twitch.tv/commands
+	if c.Queued() != 0 {
+		t.Errorf("Expected nothing to be replayed, %d messages queued", c.Queued())
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"go.uber.org/zap"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 type Wrapper struct {
 	ctx    context.Context
 	cancFn context.CancelFunc
@@ -28,21 +30,39 @@ func NewWrapper(ctx context.Context, cancFn context.CancelFunc) Wrapper {
 	}
 }
 
+// Execute runs fn until a signal is received, then cancels the context and waits for fn to return
+//
+// The process is forced to exit if fn takes too long or a second signal is received
 func (w *Wrapper) Execute(fn func(context.Context)) {
 	zap.S().Info("Starting application...")
 
-	go fn(w.ctx)
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		fn(w.ctx)
+	}()
+
+	select {
+	case <-w.sig:
+	case <-finished:
+		zap.S().Info("Application stopped on its own")
+	}
 
-	<-w.sig
 	w.cancFn()
 
 	zap.S().Info("Shutting down application...")
 
-	go func() {
-		<-time.After(10 * time.Second)
+	select {
+	case <-finished:
+	case <-w.sig:
+		zap.S().Error("Forced to shutdown, because a second signal was received")
+		os.Exit(1)
+	case <-time.After(shutdownTimeout):
 		zap.S().Error("Forced to shutdown, because the shutdown took too long")
 		os.Exit(1)
-	}()
+	}
 
 	zap.S().Info("Shutdown complete")
 
@@ -0,0 +1,276 @@
+package irc
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrEmptyMessage   = errors.New("irc message is empty")
+	ErrMissingCommand = errors.New("irc message has no command")
+)
+
+// Prefix is the source of a message, formatted as nick!user@host
+type Prefix struct {
+	Name string
+	User string
+	Host string
+}
+
+func (p *Prefix) String() string {
+	var sb strings.Builder
+
+	sb.WriteString(p.Name)
+
+	if p.User != "" {
+		sb.WriteByte('!')
+		sb.WriteString(p.User)
+	}
+
+	if p.Host != "" {
+		sb.WriteByte('@')
+		sb.WriteString(p.Host)
+	}
+
+	return sb.String()
+}
+
+// Message is a single IRCv3 message
+//
+// See https://ircv3.net/specs/extensions/message-tags and https://modern.ircdocs.horse/#message-format
+type Message struct {
+	// Tags are stored unescaped, a tag without a value has an empty string
+	Tags    map[string]string
+	Prefix  *Prefix
+	Command string
+	// Params contains every parameter, including the trailing one
+	Params []string
+}
+
+// Parse parses a single line into a Message
+//
+// Any trailing \r\n is ignored
+func Parse(line string) (*Message, error) {
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.TrimSpace(line) == "" {
+		return nil, ErrEmptyMessage
+	}
+
+	msg := &Message{
+		Tags:   make(map[string]string),
+		Params: make([]string, 0),
+	}
+
+	if line[0] == '@' {
+		var raw string
+		raw, line = cut(line[1:])
+
+		for _, tag := range strings.Split(raw, ";") {
+			if tag == "" {
+				continue
+			}
+
+			key, value, _ := strings.Cut(tag, "=")
+			msg.Tags[key] = UnescapeTagValue(value)
+		}
+	}
+
+	line = strings.TrimLeft(line, " ")
+
+	if strings.HasPrefix(line, ":") {
+		var raw string
+		raw, line = cut(line[1:])
+
+		msg.Prefix = parsePrefix(raw)
+	}
+
+	line = strings.TrimLeft(line, " ")
+
+	msg.Command, line = cut(line)
+	if msg.Command == "" {
+		return nil, ErrMissingCommand
+	}
+
+	msg.Command = strings.ToUpper(msg.Command)
+
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+
+		if line[0] == ':' {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+
+		var param string
+		param, line = cut(line)
+
+		msg.Params = append(msg.Params, param)
+	}
+
+	return msg, nil
+}
+
+// Param returns the parameter at index i or an empty string if it does not exist
+func (m *Message) Param(i int) string {
+	if i < 0 || i >= len(m.Params) {
+		return ""
+	}
+
+	return m.Params[i]
+}
+
+// Trailing returns the last parameter, which is usually the message text
+func (m *Message) Trailing() string {
+	return m.Param(len(m.Params) - 1)
+}
+
+// Tag returns the value of a tag and if it was present
+func (m *Message) Tag(key string) (string, bool) {
+	v, ok := m.Tags[key]
+	return v, ok
+}
+
+// Channel returns the channel name without the leading # if the first parameter is a channel
+func (m *Message) Channel() string {
+	first := m.Param(0)
+	if !strings.HasPrefix(first, "#") {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimPrefix(first, "#"))
+}
+
+// String formats the message as it would be sent on the wire, without a trailing \r\n
+//
+// Tags are written in a sorted order to keep the output stable
+func (m *Message) String() string {
+	var sb strings.Builder
+
+	if len(m.Tags) > 0 {
+		keys := make([]string, 0, len(m.Tags))
+		for key := range m.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		sb.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				sb.WriteByte(';')
+			}
+
+			sb.WriteString(key)
+
+			if value := m.Tags[key]; value != "" {
+				sb.WriteByte('=')
+				sb.WriteString(EscapeTagValue(value))
+			}
+		}
+		sb.WriteByte(' ')
+	}
+
+	if m.Prefix != nil {
+		sb.WriteByte(':')
+		sb.WriteString(m.Prefix.String())
+		sb.WriteByte(' ')
+	}
+
+	sb.WriteString(m.Command)
+
+	for i, param := range m.Params {
+		sb.WriteByte(' ')
+
+		last := i == len(m.Params)-1
+		if last && (len(m.Params) > 1 || param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
+			sb.WriteByte(':')
+		}
+
+		sb.WriteString(param)
+	}
+
+	return sb.String()
+}
+
+var (
+	tagEscaper = strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\:",
+		" ", "\\s",
+		"\r", "\\r",
+		"\n", "\\n",
+	)
+)
+
+// EscapeTagValue escapes a tag value according to the IRCv3 message-tags spec
+func EscapeTagValue(value string) string {
+	return tagEscaper.Replace(value)
+}
+
+// UnescapeTagValue reverses EscapeTagValue
+//
+// Unknown escape sequences drop the backslash, and a lone trailing backslash is removed
+func UnescapeTagValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(value))
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(value) {
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(value[i])
+		}
+	}
+
+	return sb.String()
+}
+
+func parsePrefix(raw string) *Prefix {
+	p := &Prefix{}
+
+	rest, host, hasHost := strings.Cut(raw, "@")
+	if hasHost {
+		p.Host = host
+	}
+
+	name, user, hasUser := strings.Cut(rest, "!")
+	if hasUser {
+		p.User = user
+	}
+
+	p.Name = name
+
+	return p
+}
+
+// cut splits s at the first space
+func cut(s string) (string, string) {
+	before, after, _ := strings.Cut(s, " ")
+	return before, after
+}
@@ -0,0 +1,145 @@
+package irc
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		Line    string
+		Command string
+		Params  []string
+		Tags    map[string]string
+		Prefix  *Prefix
+	}{
+		{
+			"PRIVMSG #forsen :forsenE forsenE\r\n",
+			"PRIVMSG",
+			[]string{"#forsen", "forsenE forsenE"},
+			map[string]string{},
+			nil,
+		},
+		{
+			"@client-nonce=abc;reply-parent-msg-id=b34ccfc7-4977-403a-8a94-33c6bac34fb8 PRIVMSG #pajlada :reply\r\n",
+			"PRIVMSG",
+			[]string{"#pajlada", "reply"},
+			map[string]string{
+				"client-nonce":        "abc",
+				"reply-parent-msg-id": "b34ccfc7-4977-403a-8a94-33c6bac34fb8",
+			},
+			nil,
+		},
+		{
+			`@system-msg=Hello\sWorld\:\;empty=;flag :tmi.twitch.tv USERNOTICE #forsen :`,
+			"USERNOTICE",
+			[]string{"#forsen", ""},
+			map[string]string{
+				"system-msg": "Hello World;",
+				"empty":      "",
+				"flag":       "",
+			},
+			&Prefix{Name: "tmi.twitch.tv"},
+		},
+		{
+			":melon!melon@melon.tmi.twitch.tv JOIN #forsen,#pajlada",
+			"JOIN",
+			[]string{"#forsen,#pajlada"},
+			map[string]string{},
+			&Prefix{Name: "melon", User: "melon", Host: "melon.tmi.twitch.tv"},
+		},
+		{
+			"cap req :twitch.tv/tags twitch.tv/commands",
+			"CAP",
+			[]string{"req", "twitch.tv/tags twitch.tv/commands"},
+			map[string]string{},
+			nil,
+		},
+		{
+			"PING",
+			"PING",
+			[]string{},
+			map[string]string{},
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		msg, err := Parse(testCase.Line)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %s", testCase.Line, err)
+		}
+
+		if msg.Command != testCase.Command {
+			t.Errorf("Expected command %s, got %s", testCase.Command, msg.Command)
+		}
+
+		if len(msg.Params) != len(testCase.Params) {
+			t.Fatalf("Expected %d params, got %d (%q)", len(testCase.Params), len(msg.Params), msg.Params)
+		}
+
+		for i, param := range testCase.Params {
+			if msg.Params[i] != param {
+				t.Errorf("Expected param %d to be %q, got %q", i, param, msg.Params[i])
+			}
+		}
+
+		if len(msg.Tags) != len(testCase.Tags) {
+			t.Errorf("Expected %d tags, got %d", len(testCase.Tags), len(msg.Tags))
+		}
+
+		for key, value := range testCase.Tags {
+			if got, ok := msg.Tag(key); !ok || got != value {
+				t.Errorf("Expected tag %s to be %q, got %q", key, value, got)
+			}
+		}
+
+		if testCase.Prefix == nil && msg.Prefix != nil {
+			t.Errorf("Expected no prefix, got %v", msg.Prefix)
+		} else if testCase.Prefix != nil && (msg.Prefix == nil || *msg.Prefix != *testCase.Prefix) {
+			t.Errorf("Expected prefix %v, got %v", testCase.Prefix, msg.Prefix)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse("\r\n"); err != ErrEmptyMessage {
+		t.Error("Expected ErrEmptyMessage")
+	}
+
+	if _, err := Parse("@foo=bar :prefix"); err != ErrMissingCommand {
+		t.Error("Expected ErrMissingCommand")
+	}
+}
+
+func TestChannel(t *testing.T) {
+	msg, _ := Parse("PRIVMSG #Forsen :hi")
+	if msg.Channel() != "forsen" {
+		t.Errorf("Expected channel forsen, got %s", msg.Channel())
+	}
+
+	msg, _ = Parse("NOTICE * :Login authentication failed")
+	if msg.Channel() != "" {
+		t.Errorf("Expected no channel, got %s", msg.Channel())
+	}
+}
+
+func TestString(t *testing.T) {
+	testCases := []string{
+		"@client-nonce=abc;reply-parent-msg-id=123 PRIVMSG #forsen :hello there",
+		`@msg=semi\:colon\sand\\slash :tmi.twitch.tv NOTICE * :text`,
+		":melon!melon@melon.tmi.twitch.tv JOIN #forsen",
+		"PRIVMSG #forsen :single",
+		"PING",
+	}
+
+	for _, line := range testCases {
+		msg, err := Parse(line)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %s", line, err)
+		}
+
+		if msg.String() != line {
+			t.Errorf("Expected %q, got %q", line, msg.String())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package messagescheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+const (
+	// How long a channel is held back the first time Twitch says we are sending too quickly
+	MinBackoff = 2 * time.Second
+	// Backing off never holds a channel back for longer than this
+	MaxBackoff = 30 * time.Second
+)
+
+/*
+BackoffPolicy holds channels back after Twitch refused to send a message.
+
+Every Backoff doubles how long the channel is held back, until Reset is called
+once Twitch accepts a message again.
+*/
+type BackoffPolicy struct {
+	mu       sync.RWMutex
+	until    map[string]time.Time
+	backoffs map[string]time.Duration
+}
+
+func NewBackoffPolicy() *BackoffPolicy {
+	return &BackoffPolicy{
+		until:    make(map[string]time.Time),
+		backoffs: make(map[string]time.Duration),
+	}
+}
+
+// Hold keeps a channel from being sent messages for d, it never shortens an earlier hold
+func (p *BackoffPolicy) Hold(channel string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.hold(channel, time.Now().Add(d))
+}
+
+func (p *BackoffPolicy) hold(channel string, until time.Time) {
+	if until.After(p.until[channel]) {
+		p.until[channel] = until
+	}
+}
+
+// Backoff holds a channel back for twice as long as the previous time, returning how long it is held back for
+func (p *BackoffPolicy) Backoff(channel string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d := p.backoffs[channel] * 2
+	if d < MinBackoff {
+		d = MinBackoff
+	}
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+
+	p.backoffs[channel] = d
+	p.hold(channel, time.Now().Add(d))
+
+	return d
+}
+
+// Reset makes the next Backoff start over, holds which haven't ended yet are kept
+func (p *BackoffPolicy) Reset(channel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.backoffs, channel)
+}
+
+// Forget removes every hold on a channel
+func (p *BackoffPolicy) Forget(channel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.backoffs, channel)
+	delete(p.until, channel)
+}
+
+func (p *BackoffPolicy) NextSend(channel string, perm dbmodels.BotPermmision, last time.Time) time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if until := p.until[channel]; until.After(last) {
+		return until
+	}
+
+	return last
+}
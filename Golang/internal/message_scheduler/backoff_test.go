@@ -0,0 +1,53 @@
+package messagescheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestBackoffDoubles(t *testing.T) {
+	p := NewBackoffPolicy()
+
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, e := range expected {
+		if d := p.Backoff("test"); d != e {
+			t.Errorf("Expected backoff %d to be %s, got %s", i, e, d)
+		}
+	}
+
+	p.Reset("test")
+	if d := p.Backoff("test"); d != MinBackoff {
+		t.Errorf("Expected the backoff to start over after a reset, got %s", d)
+	}
+}
+
+func TestBackoffHolds(t *testing.T) {
+	p := NewBackoffPolicy()
+	last := time.Now()
+
+	if next := p.NextSend("test", dbmodels.WritePermission, last); !next.Equal(last) {
+		t.Error("Expected a channel without a hold not to be limited")
+	}
+
+	p.Hold("test", time.Minute)
+	if next := p.NextSend("test", dbmodels.BotPermission, last); next.Sub(last) < 59*time.Second {
+		t.Errorf("Expected the channel to be held for a minute, got %s", next.Sub(last))
+	}
+
+	// A shorter hold doesn't end the longer one
+	p.Hold("test", time.Second)
+	if next := p.NextSend("test", dbmodels.BotPermission, last); next.Sub(last) < 59*time.Second {
+		t.Errorf("Expected the longer hold to be kept, got %s", next.Sub(last))
+	}
+
+	if next := p.NextSend("other", dbmodels.WritePermission, last); !next.Equal(last) {
+		t.Error("Expected other channels not to be held")
+	}
+
+	p.Forget("test")
+	if next := p.NextSend("test", dbmodels.WritePermission, last); !next.Equal(last) {
+		t.Error("Expected the hold to be removed")
+	}
+}
@@ -0,0 +1,189 @@
+package messagescheduler
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Tag clients set on PRIVMSG to send a message at a given time, in unix milliseconds
+	SendAtTag = "melon-send-at"
+	// Tag clients set on PRIVMSG to send a message after a delay, in milliseconds
+	DelayTag = "melon-delay"
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found in message scheduler")
+	ErrInvalidSendAt   = errors.New("invalid send-at time")
+)
+
+// ParseSendAt parses a time in unix milliseconds
+func ParseSendAt(s string) (time.Time, error) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}, ErrInvalidSendAt
+	}
+
+	return time.UnixMilli(ms), nil
+}
+
+// ParseDelay parses a delay in milliseconds
+func ParseDelay(s string) (time.Duration, error) {
+	ms, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, ErrInvalidSendAt
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Holds a message until its SendAt time, it is already in the store
+func (ms *MessageScheduler) delay(msg *MessageContext) {
+	ms.mu.Lock()
+	ms.delayed[msg.ID] = msg
+	ms.mu.Unlock()
+
+	ms.wakeDelayLoop()
+}
+
+func (ms *MessageScheduler) wakeDelayLoop() {
+	select {
+	case ms.delayWake <- struct{}{}:
+	default:
+	}
+}
+
+// Scheduled returns every message waiting for its SendAt time, the earliest first
+func (ms *MessageScheduler) Scheduled() []MessageContext {
+	ms.mu.RLock()
+	msgs := make([]MessageContext, 0, len(ms.delayed))
+	for _, msg := range ms.delayed {
+		msgs = append(msgs, *msg)
+	}
+	ms.mu.RUnlock()
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].SendAt.Before(msgs[j].SendAt)
+	})
+
+	return msgs
+}
+
+// Cancel removes a message which is waiting for its SendAt time, or is queued
+func (ms *MessageScheduler) Cancel(id string) (MessageContext, error) {
+	ms.mu.Lock()
+	msg, ok := ms.delayed[id]
+	delete(ms.delayed, id)
+	ms.mu.Unlock()
+
+	if !ok {
+		for _, schedule := range ms.schedules() {
+			if msg = schedule.remove(id); msg != nil {
+				break
+			}
+		}
+	}
+
+	if msg == nil {
+		return MessageContext{}, ErrMessageNotFound
+	}
+
+	ms.forget(*msg)
+
+	return *msg, nil
+}
+
+// Returns the messages which are due, removing them from the delayed messages,
+// along with when the next message is due
+func (ms *MessageScheduler) due(now time.Time) ([]*MessageContext, time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var (
+		due  []*MessageContext
+		next time.Time
+	)
+
+	for id, msg := range ms.delayed {
+		if !msg.SendAt.After(now) {
+			due = append(due, msg)
+			delete(ms.delayed, id)
+			continue
+		}
+
+		if next.IsZero() || msg.SendAt.Before(next) {
+			next = msg.SendAt
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].SendAt.Before(due[j].SendAt)
+	})
+
+	return due, next
+}
+
+// Queues a delayed message which is due, returning the message it pushed out of the queue if any
+func (ms *MessageScheduler) pushDelayed(msg *MessageContext) (*MessageContext, error) {
+	// Held until the message is queued, so RemoveChannel can't remove the channel in between
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	c, err := ms.speakable(msg.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.push(msg)
+}
+
+// Moves delayed messages into their channel's queue once they are due
+//
+// Like the channel loops it sleeps until the next message is due, or a new message is delayed
+func (ms *MessageScheduler) delayLoop() {
+	for {
+		due, next := ms.due(time.Now())
+
+		for _, msg := range due {
+			// The channel might have been left, or switched to read, while the message was delayed
+			dropped, err := ms.pushDelayed(msg)
+			if err != nil {
+				zap.S().Infow("Dropping delayed message", "id", msg.ID, "error", err)
+
+				ms.forget(*msg)
+				ms.drop(*msg, err)
+				continue
+			}
+
+			if dropped != nil {
+				ms.forget(*dropped)
+				ms.drop(*dropped, ErrQueueFull)
+			}
+		}
+
+		var (
+			timer *time.Timer
+			fire  <-chan time.Time
+		)
+
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+
+		select {
+		case <-ms.delayCtx.Done():
+			return
+		case <-ms.delayWake:
+		case <-fire:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package messagescheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestParseSendAt(t *testing.T) {
+	at, err := ParseSendAt("1700000000000")
+	if err != nil || !at.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("ParseSendAt returned %s, %v", at, err)
+	}
+
+	if _, err := ParseSendAt("tomorrow"); err != ErrInvalidSendAt {
+		t.Errorf("Expected ErrInvalidSendAt, got %v", err)
+	}
+
+	if delay, err := ParseDelay("250"); err != nil || delay != 250*time.Millisecond {
+		t.Errorf("ParseDelay returned %s, %v", delay, err)
+	}
+}
+
+func TestDelayedMessage(t *testing.T) {
+	store := newMemoryStore()
+
+	s := NewMessageScheduler(context.Background())
+	s.SetStore(store)
+
+	sent := make(chan time.Time, 1)
+	s.SetOnMessage(func(ctx MessageContext) {
+		sent <- time.Now()
+	})
+
+	s.AddChannel("test", dbmodels.BotPermission)
+	s.Run()
+
+	sendAt := time.Now().Add(200 * time.Millisecond)
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "later", SendAt: sendAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	if scheduled := s.Scheduled(); len(scheduled) != 1 || scheduled[0].Message != "later" {
+		t.Fatalf("Expected the message to be scheduled, got %+v", scheduled)
+	}
+
+	s.flushStore()
+
+	if store.Len() != 1 {
+		t.Errorf("Expected the delayed message to be stored, got %d", store.Len())
+	}
+
+	select {
+	case at := <-sent:
+		if at.Before(sendAt) {
+			t.Errorf("Message sent %s too early", sendAt.Sub(at))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the delayed message")
+	}
+
+	if scheduled := s.Scheduled(); len(scheduled) != 0 {
+		t.Errorf("Expected no scheduled messages, got %d", len(scheduled))
+	}
+}
+
+func TestCancelDelayedMessage(t *testing.T) {
+	store := newMemoryStore()
+
+	s := NewMessageScheduler(context.Background())
+	s.SetStore(store)
+	s.SetOnMessage(func(ctx MessageContext) {
+		t.Error("Cancelled message was sent")
+	})
+
+	s.AddChannel("test", dbmodels.BotPermission)
+	s.Run()
+
+	if err := s.AddMessage(MessageContext{ID: "abc", Channel: "test", Message: "later", SendAt: time.Now().Add(100 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := s.Cancel("abc")
+	if err != nil || msg.Message != "later" {
+		t.Fatalf("Cancel returned %+v, %v", msg, err)
+	}
+
+	if _, err := s.Cancel("abc"); err != ErrMessageNotFound {
+		t.Errorf("Expected ErrMessageNotFound, got %v", err)
+	}
+
+	s.flushStore()
+
+	if store.Len() != 0 {
+		t.Errorf("Expected the cancelled message to be removed from the store, got %d", store.Len())
+	}
+
+	time.Sleep(300 * time.Millisecond)
+}
+
+func TestRestoreDelayedMessage(t *testing.T) {
+	store := newMemoryStore()
+	store.Save(context.Background(), MessageContext{ID: "1", Channel: "test", Message: "later", SendAt: time.Now().Add(time.Hour)})
+
+	s := NewMessageScheduler(context.Background())
+	s.SetStore(store)
+
+	if err := s.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	if scheduled := s.Scheduled(); len(scheduled) != 1 || scheduled[0].ID != "1" {
+		t.Errorf("Expected the delayed message to be restored, got %+v", scheduled)
+	}
+}
@@ -0,0 +1,32 @@
+package messagescheduler
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrExpired    = errors.New("message expired before it could be sent")
+	ErrInvalidTTL = errors.New("invalid ttl")
+)
+
+const (
+	// Tag clients set on PRIVMSG to give a message a deadline, in milliseconds from now
+	TTLTag = "melon-ttl"
+)
+
+// ParseTTL parses a TTL in milliseconds
+func ParseTTL(s string) (time.Duration, error) {
+	ms, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || ms == 0 {
+		return 0, ErrInvalidTTL
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Expired returns true if the message has a deadline which has passed
+func (ctx *MessageContext) Expired(now time.Time) bool {
+	return !ctx.Deadline.IsZero() && now.After(ctx.Deadline)
+}
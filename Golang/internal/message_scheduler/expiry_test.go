@@ -0,0 +1,81 @@
+package messagescheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestParseTTL(t *testing.T) {
+	if ttl, err := ParseTTL("1500"); err != nil || ttl != 1500*time.Millisecond {
+		t.Errorf("ParseTTL(\"1500\") = %s, %v", ttl, err)
+	}
+
+	for _, input := range []string{"", "0", "-5", "soon"} {
+		if _, err := ParseTTL(input); err != ErrInvalidTTL {
+			t.Errorf("ParseTTL(%q) expected ErrInvalidTTL, got %v", input, err)
+		}
+	}
+}
+
+func TestPopSkipsExpired(t *testing.T) {
+	cs := NewChannelSchedule(context.Background(), dbmodels.WritePermission)
+
+	cs.push(&MessageContext{Message: "expired", Deadline: time.Now().Add(-time.Second)})
+	cs.push(&MessageContext{Message: "fresh", Deadline: time.Now().Add(time.Hour)})
+	cs.push(&MessageContext{Message: "forever"})
+
+	msg, expired := cs.pop()
+	if msg == nil || msg.Message != "fresh" {
+		t.Errorf("Expected fresh message, got %+v", msg)
+	}
+
+	if len(expired) != 1 || expired[0].Message != "expired" {
+		t.Errorf("Expected the expired message to be returned, got %+v", expired)
+	}
+
+	if cs.Len() != 1 {
+		t.Errorf("Expected 1 message left, got %d", cs.Len())
+	}
+}
+
+func TestExpiredMessagesAreDropped(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+
+	sent := make(chan MessageContext, 10)
+	dropped := make(chan error, 10)
+
+	s.SetOnMessage(func(ctx MessageContext) {
+		sent <- ctx
+	})
+	s.SetOnDrop(func(ctx MessageContext, reason error) {
+		if ctx.ClientID != 42 {
+			t.Errorf("Expected ClientID 42, got %d", ctx.ClientID)
+		}
+
+		dropped <- reason
+	})
+
+	s.AddChannel("test", dbmodels.VIPPermission)
+
+	// The first message is sent after one interval, which is longer than the deadline
+	s.AddMessage(MessageContext{
+		Channel:  "test",
+		Message:  "test",
+		ClientID: 42,
+		Deadline: time.Now().Add(10 * time.Millisecond),
+	})
+
+	select {
+	case reason := <-dropped:
+		if reason != ErrExpired {
+			t.Errorf("Expected ErrExpired, got %v", reason)
+		}
+	case <-sent:
+		t.Error("Expired message was sent")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message to be dropped")
+	}
+}
@@ -3,166 +3,1059 @@ package messagescheduler
 import (
 	"context"
 	"errors"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+// How long restored messages wait for their channel to be added before they are dropped
+const DefaultRestoreTimeout = 5 * time.Minute
+
 var (
-	ErrChanNotFound = errors.New("channel not found in message scheduler")
+	ErrChanNotFound   = errors.New("channel not found in message scheduler")
+	ErrReadOnly       = errors.New("bot is not allowed to speak in channel")
+	ErrChannelRemoved = errors.New("channel was removed from message scheduler")
 )
 
 type MessageContext struct {
-	Channel string
-	Message string
-	ReplyTo *string
+	// Unique ID, assigned by AddMessage if empty
+	ID      string  `json:"id"`
+	Channel string  `json:"channel"`
+	Message string  `json:"message"`
+	ReplyTo *string `json:"reply_to,omitempty"`
+	// Tags the client sent along with the message
+	Tags map[string]string `json:"tags,omitempty"`
+	// Higher priorities are sent first, see PriorityTag
+	Priority Priority `json:"priority"`
+	// The message is dropped if it can't be sent before Deadline, the zero value never expires
+	Deadline time.Time `json:"deadline"`
+	// When the message was added to a queue
+	QueuedAt time.Time `json:"queued_at"`
+	// The message is held back until SendAt, the zero value sends it right away
+	SendAt time.Time `json:"send_at"`
+	// ID of the client the message came from, used to tell the client about dropped messages
+	//
+	// It isn't stored, as client IDs don't survive a restart
+	ClientID uint64 `json:"-"`
+
+	// The sender has been told the message is held
+	held bool
 }
 
+// ChannelSchedule is the queue of a single channel
+//
+// Every method is safe to call from multiple goroutines
 type ChannelSchedule struct {
-	Interval     dbmodels.BotPermmision
-	MessageQueue []*MessageContext
-	Ctx          context.Context
+	// Name of the channel
+	Name   string
+	Ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	interval dbmodels.BotPermmision
+	queue    []*MessageContext
+	limit    QueueLimit
+	draining bool
+	// Signals the channel loop that something changed, it never blocks the sender
+	wake chan struct{}
+	// Closed once the channel loop has returned
+	stopped chan struct{}
 }
 
 func NewChannelSchedule(ctx context.Context, interval dbmodels.BotPermmision) *ChannelSchedule {
+	ctx, cancel := context.WithCancel(ctx)
+
 	return &ChannelSchedule{
-		Interval:     interval,
-		MessageQueue: make([]*MessageContext, 0),
-		Ctx:          ctx,
+		Ctx:      ctx,
+		cancel:   cancel,
+		interval: interval,
+		queue:    make([]*MessageContext, 0),
+		wake:     make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Stop stops the channel loop, messages left in the queue are not sent
+func (cs *ChannelSchedule) Stop() {
+	cs.cancel()
+}
+
+// Makes the channel loop return once the queue is empty
+func (cs *ChannelSchedule) drain() {
+	cs.mu.Lock()
+	cs.draining = true
+	cs.mu.Unlock()
+
+	cs.notify()
+}
+
+func (cs *ChannelSchedule) isDraining() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.draining
+}
+
+// Removes every message from the queue
+func (cs *ChannelSchedule) flush() []MessageContext {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	msgs := make([]MessageContext, 0, len(cs.queue))
+	for _, msg := range cs.queue {
+		msgs = append(msgs, *msg)
 	}
+
+	cs.queue = make([]*MessageContext, 0)
+
+	return msgs
 }
 
 func (cs *ChannelSchedule) IntervalIsCurrently(interval dbmodels.BotPermmision) bool {
-	return cs.Interval == interval
+	return cs.Interval() == interval
+}
+
+// Interval returns the permission the channel is currently sending with
+func (cs *ChannelSchedule) Interval() dbmodels.BotPermmision {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.interval
+}
+
+func (cs *ChannelSchedule) setInterval(interval dbmodels.BotPermmision) {
+	cs.mu.Lock()
+	cs.interval = interval
+	cs.mu.Unlock()
+
+	cs.notify()
+}
+
+// Len returns the amount of messages waiting to be sent
+func (cs *ChannelSchedule) Len() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return len(cs.queue)
+}
+
+// Sets the maximum length of the queue, messages already queued are kept
+func (cs *ChannelSchedule) SetLimit(limit QueueLimit) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.limit = limit
+}
+
+// Adds a message to the queue, applying the queue limit
+//
+// A message which had to make room for ctx is returned, so the sender can be told it was dropped
+func (cs *ChannelSchedule) push(ctx *MessageContext) (*MessageContext, error) {
+	if ctx.QueuedAt.IsZero() {
+		ctx.QueuedAt = time.Now()
+	}
+
+	cs.mu.Lock()
+	defer cs.notify()
+	defer cs.mu.Unlock()
+
+	if cs.limit.Policy == CollapseIdentical {
+		for _, queued := range cs.queue {
+			if identical(queued, ctx) {
+				collapse(queued, ctx)
+				return nil, ErrCollapsed
+			}
+		}
+	}
+
+	var dropped *MessageContext
+	if len(cs.queue) >= cs.limit.size() {
+		if cs.limit.Policy != DropOldest {
+			return nil, ErrQueueFull
+		}
+
+		dropped = cs.queue[0]
+		cs.queue[0] = nil
+		cs.queue = cs.queue[1:]
+	}
+
+	cs.queue = append(cs.queue, ctx)
+
+	return dropped, nil
+}
+
+// Removes a message by its ID, nil if it isn't queued
+func (cs *ChannelSchedule) remove(id string) *MessageContext {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for i, msg := range cs.queue {
+		if msg.ID != id {
+			continue
+		}
+
+		copy(cs.queue[i:], cs.queue[i+1:])
+		cs.queue[len(cs.queue)-1] = nil
+		cs.queue = cs.queue[:len(cs.queue)-1]
+
+		return msg
+	}
+
+	return nil
+}
+
+// Removes and returns the messages past their deadline, cs.mu has to be held
+func (cs *ChannelSchedule) expire(now time.Time) []*MessageContext {
+	var expired []*MessageContext
+
+	queue := cs.queue[:0]
+	for _, msg := range cs.queue {
+		if msg.Expired(now) {
+			expired = append(expired, msg)
+			continue
+		}
+
+		queue = append(queue, msg)
+	}
+
+	for i := len(queue); i < len(cs.queue); i++ {
+		cs.queue[i] = nil
+	}
+	cs.queue = queue
+
+	return expired
+}
+
+// Removes and returns the messages past their deadline
+func (cs *ChannelSchedule) removeExpired() []*MessageContext {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.expire(time.Now())
+}
+
+// Marks every queued message as held, returning the ones which weren't already
+func (cs *ChannelSchedule) markHeld() []MessageContext {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var held []MessageContext
+	for _, msg := range cs.queue {
+		if msg.held {
+			continue
+		}
+
+		msg.held = true
+		held = append(held, *msg)
+	}
+
+	return held
+}
+
+// Returns the earliest deadline of the queued messages, the zero value if none of them expire
+func (cs *ChannelSchedule) nextDeadline() time.Time {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var next time.Time
+	for _, msg := range cs.queue {
+		if msg.Deadline.IsZero() {
+			continue
+		}
+
+		if next.IsZero() || msg.Deadline.Before(next) {
+			next = msg.Deadline
+		}
+	}
+
+	return next
+}
+
+// Removes the message with the highest priority, nil if the queue is empty
+//
+// Messages with the same priority are sent in the order they were added,
+// expired messages are removed from the queue and returned separately
+func (cs *ChannelSchedule) pop() (*MessageContext, []*MessageContext) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	expired := cs.expire(now)
+
+	if len(cs.queue) == 0 {
+		return nil, expired
+	}
+
+	best := 0
+	for i := 1; i < len(cs.queue); i++ {
+		if effectivePriority(cs.queue[i], now) > effectivePriority(cs.queue[best], now) {
+			best = i
+		}
+	}
+
+	msg := cs.queue[best]
+	copy(cs.queue[best:], cs.queue[best+1:])
+	cs.queue[len(cs.queue)-1] = nil
+	cs.queue = cs.queue[:len(cs.queue)-1]
+
+	return msg, expired
+}
+
+func (cs *ChannelSchedule) notify() {
+	select {
+	case cs.wake <- struct{}{}:
+	default:
+	}
 }
 
 // MessageScheduler sends one message within a given interval to a channel
 type MessageScheduler struct {
-	// Catch all scheduler which puts messages that don't have a channel in here
-	// It defaults to the lowest permission level (WritePermission) and can't be changed
-	CatchAllScheduler *ChannelSchedule
-	ChannelSchedules  map[string]*ChannelSchedule
-	Ctx               context.Context
-	OnMessage         func(ctx MessageContext)
+	Ctx context.Context
+
+	mu      sync.RWMutex
+	running bool
+	// Set once Shutdown is called, channels removed after that keep their stored messages
+	closing   bool
+	channels  map[string]*ChannelSchedule
+	onMessage func(ctx MessageContext)
+	onDrop    func(ctx MessageContext, reason error)
+	onHold    func(ctx MessageContext, reason error)
+	// Limit given to channels as they are added
+	queueLimit QueueLimit
+	store      Store
+	storeOps   chan storeOp
+	// Messages loaded by Restore, waiting for their channel to be added
+	restored       map[string][]*MessageContext
+	restoreTimeout time.Duration
+	// Messages waiting for their SendAt time, by ID
+	delayed     map[string]*MessageContext
+	delayWake   chan struct{}
+	delayCtx    context.Context
+	delayCancel context.CancelFunc
+	// Shared by every channel, so a burst across many channels doesn't get the bot throttled
+	limiter *GlobalLimiter
+	policy  RatePolicy
+	gate    Gate
 }
 
 func NewMessageScheduler(ctx context.Context) *MessageScheduler {
-	return &MessageScheduler{
-		CatchAllScheduler: NewChannelSchedule(ctx, dbmodels.WritePermission),
-		ChannelSchedules:  make(map[string]*ChannelSchedule),
-		Ctx:               ctx,
-		OnMessage:         func(ctx MessageContext) {},
+	delayCtx, delayCancel := context.WithCancel(ctx)
+
+	ms := &MessageScheduler{
+		Ctx:            ctx,
+		channels:       make(map[string]*ChannelSchedule),
+		onMessage:      func(ctx MessageContext) {},
+		onDrop:         func(ctx MessageContext, reason error) {},
+		onHold:         func(ctx MessageContext, reason error) {},
+		limiter:        NewGlobalLimiter(false),
+		policy:         PermissionPolicy{},
+		store:          noopStore{},
+		storeOps:       make(chan storeOp, storeQueueSize),
+		restored:       make(map[string][]*MessageContext),
+		restoreTimeout: DefaultRestoreTimeout,
+		delayed:        make(map[string]*MessageContext),
+		delayWake:      make(chan struct{}, 1),
+		delayCtx:       delayCtx,
+		delayCancel:    delayCancel,
+	}
+
+	go ms.storeLoop()
+
+	return ms
+}
+
+// SetStore sets where queued messages are kept, so they can be sent after a restart
+func (ms *MessageScheduler) SetStore(store Store) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.store = store
+}
+
+func (ms *MessageScheduler) getStore() Store {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.store
+}
+
+func (ms *MessageScheduler) save(ctx MessageContext) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	ms.write(storeOp{msg: ctx})
+}
+
+func (ms *MessageScheduler) forget(ctx MessageContext) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	ms.write(storeOp{msg: ctx, delete: true})
+}
+
+// Queues a store write, the caller has to hold ms.mu
+//
+// Writes are queued under the lock so a message is saved before anyone can forget it
+func (ms *MessageScheduler) write(op storeOp) {
+	op.store = ms.store
+
+	select {
+	case ms.storeOps <- op:
+	default:
+		zap.S().Warnw("Too many store writes waiting, discarding", "id", op.msg.ID, "delete", op.delete)
+	}
+}
+
+// Waits for the store writes queued so far to be done
+func (ms *MessageScheduler) flushStore() {
+	done := make(chan struct{})
+
+	select {
+	case ms.storeOps <- storeOp{done: done}:
+	case <-ms.Ctx.Done():
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ms.Ctx.Done():
+	}
+}
+
+// Does the store writes in the order they were queued, so neither clients nor the channel loops wait on the store
+func (ms *MessageScheduler) storeLoop() {
+	for {
+		var op storeOp
+
+		select {
+		case <-ms.Ctx.Done():
+			return
+		case op = <-ms.storeOps:
+		}
+
+		switch {
+		case op.done != nil:
+			close(op.done)
+		case op.delete:
+			if err := op.store.Delete(ms.Ctx, op.msg.ID); err != nil {
+				zap.S().Errorw("Failed to remove stored message", "id", op.msg.ID, "error", err)
+			}
+		default:
+			if err := op.store.Save(ms.Ctx, op.msg); err != nil {
+				zap.S().Errorw("Failed to store message", "id", op.msg.ID, "error", err)
+			}
+		}
+	}
+}
+
+// SetRestoreTimeout sets how long restored messages wait for their channel, it defaults to DefaultRestoreTimeout
+func (ms *MessageScheduler) SetRestoreTimeout(timeout time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.restoreTimeout = timeout
+}
+
+// Restore loads the messages left in the store by a previous run
+//
+// Expired messages are discarded, delayed messages wait for their SendAt time again,
+// the rest are queued once their channel is added. Messages whose channel isn't added
+// within the restore timeout are dropped with ErrChanNotFound.
+func (ms *MessageScheduler) Restore() error {
+	msgs, err := ms.getStore().Load(ms.Ctx)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].QueuedAt.Before(msgs[j].QueuedAt)
+	})
+
+	now := time.Now()
+	restored := 0
+	waiting := false
+
+	for i := range msgs {
+		msg := &msgs[i]
+
+		if msg.Expired(now) {
+			ms.forget(*msg)
+			continue
+		}
+
+		if msg.SendAt.After(now) {
+			ms.delay(msg)
+		} else if c, ok := ms.Channel(msg.Channel); ok {
+			ms.requeue(c, msg)
+		} else {
+			ms.mu.Lock()
+			ms.restored[msg.Channel] = append(ms.restored[msg.Channel], msg)
+			ms.mu.Unlock()
+
+			waiting = true
+		}
+
+		restored++
+	}
+
+	zap.S().Infof("Restored %d queued messages, discarded %d expired messages", restored, len(msgs)-restored)
+
+	if waiting {
+		ms.mu.RLock()
+		timeout := ms.restoreTimeout
+		ms.mu.RUnlock()
+
+		time.AfterFunc(timeout, ms.discardRestored)
+	}
+
+	return nil
+}
+
+// Drops the restored messages whose channel was never added, so they don't stay in the store forever
+func (ms *MessageScheduler) discardRestored() {
+	// Stopped before the timeout, they are kept for the next start
+	if ms.Ctx.Err() != nil {
+		return
+	}
+
+	ms.mu.Lock()
+	restored := ms.restored
+	ms.restored = make(map[string][]*MessageContext)
+	ms.mu.Unlock()
+
+	for channel, msgs := range restored {
+		zap.S().Warnf("Dropping %d restored messages, channel %s was not added", len(msgs), channel)
+
+		for _, msg := range msgs {
+			ms.forget(*msg)
+			ms.drop(*msg, ErrChanNotFound)
+		}
+	}
+}
+
+// Queues a restored message, it is already in the store
+func (ms *MessageScheduler) requeue(c *ChannelSchedule, msg *MessageContext) {
+	dropped, err := c.push(msg)
+	if err != nil {
+		ms.forget(*msg)
+		return
+	}
+
+	if dropped != nil {
+		ms.forget(*dropped)
+	}
+}
+
+// SetOnDrop sets a function called for every message which is dropped instead of sent
+func (ms *MessageScheduler) SetOnDrop(f func(ctx MessageContext, reason error)) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.onDrop = f
+}
+
+// SetQueueLimit sets the maximum queue length of every channel
+func (ms *MessageScheduler) SetQueueLimit(limit QueueLimit) {
+	ms.mu.Lock()
+	ms.queueLimit = limit
+
+	schedules := make([]*ChannelSchedule, 0, len(ms.channels))
+	for _, schedule := range ms.channels {
+		schedules = append(schedules, schedule)
+	}
+	ms.mu.Unlock()
+
+	for _, schedule := range schedules {
+		schedule.SetLimit(limit)
+	}
+}
+
+// SetRatePolicy replaces the policy deciding how far apart messages to a channel are, it defaults to PermissionPolicy
+func (ms *MessageScheduler) SetRatePolicy(policy RatePolicy) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.policy = policy
+}
+
+func (ms *MessageScheduler) ratePolicy() RatePolicy {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.policy
+}
+
+// Reschedule makes a channel check its rate policy again, call it after changing a policy
+func (ms *MessageScheduler) Reschedule(channel string) {
+	if c, ok := ms.Channel(channel); ok {
+		c.notify()
 	}
 }
 
+// SetOnHold sets a function called once for every message held back by the gate
+func (ms *MessageScheduler) SetOnHold(f func(ctx MessageContext, reason error)) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.onHold = f
+}
+
+// SetGate sets what decides if a channel can be sent messages right now, every message is allowed by default
+func (ms *MessageScheduler) SetGate(gate Gate) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.gate = gate
+}
+
+// Checks the bot may speak in the channel, and the gate if there is one
+func (ms *MessageScheduler) check(schedule *ChannelSchedule) error {
+	// The permission can change to read while messages are queued
+	if !schedule.Interval().IsAllowedToSpeak() {
+		return ErrReadOnly
+	}
+
+	ms.mu.RLock()
+	gate := ms.gate
+	ms.mu.RUnlock()
+
+	if gate == nil {
+		return nil
+	}
+
+	return gate.Check(schedule.Name, schedule.Interval())
+}
+
+// SetLimiter replaces the global rate limiter, it defaults to the limits of an unverified bot
+func (ms *MessageScheduler) SetLimiter(l *GlobalLimiter) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.limiter = l
+}
+
+// Limiter returns the global rate limiter, which can be used to inspect the remaining budget
+func (ms *MessageScheduler) Limiter() *GlobalLimiter {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.limiter
+}
+
 func (ms *MessageScheduler) SetOnMessage(f func(ctx MessageContext)) {
-	ms.OnMessage = f
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.onMessage = f
+}
+
+// Channel returns the schedule of a channel
+func (ms *MessageScheduler) Channel(channel string) (*ChannelSchedule, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	c, ok := ms.channels[channel]
+	return c, ok
 }
 
 func (ms *MessageScheduler) UpdateTimer(channel string, interval dbmodels.BotPermmision) {
-	c, ok := ms.ChannelSchedules[channel]
+	c, ok := ms.Channel(channel)
 	if !ok {
 		return
 	}
 
 	zap.S().Infof("Updating timer for channel %s to %d", channel, interval.ToMessageCooldown())
 
-	c.Interval = interval
+	c.setInterval(interval)
 }
 
 func (ms *MessageScheduler) AddChannel(channel string, interval dbmodels.BotPermmision) {
+	ms.mu.Lock()
+
 	/*
 		As clients like dt-irc listen for a JOIN response we don't bother
 		returning an error if the channel already exists
 	*/
-	if _, ok := ms.ChannelSchedules[channel]; ok {
+	if _, ok := ms.channels[channel]; ok {
+		ms.mu.Unlock()
 		return
 	}
 
 	// FIXME: SA1029
-	ms.ChannelSchedules[channel] = NewChannelSchedule(
+	schedule := NewChannelSchedule(
 		context.WithValue(ms.Ctx, "channel", channel),
 		interval,
 	)
+	schedule.Name = channel
+	schedule.SetLimit(ms.queueLimit)
+	ms.channels[channel] = schedule
+
+	restored := ms.restored[channel]
+	delete(ms.restored, channel)
+
+	ms.mu.Unlock()
+
+	for _, msg := range restored {
+		ms.requeue(schedule, msg)
+	}
 
 	zap.S().Infof("Starting message scheduler for channel %s", channel)
-	go ms.channelLoop(ms.ChannelSchedules[channel])
+	go ms.channelLoop(schedule)
 }
 
+// RemoveChannel stops a channel, messages still queued for it are dropped
+//
+// Once Shutdown has been called channels are left as they are, so Shutdown can still send
+// their messages and keep the rest in the store
 func (ms *MessageScheduler) RemoveChannel(channel string) error {
-	c, ok := ms.ChannelSchedules[channel]
+	ms.mu.Lock()
+
+	c, ok := ms.channels[channel]
 	if !ok {
+		ms.mu.Unlock()
 		return ErrChanNotFound
 	}
 
-	c.Ctx.Done()
-	delete(ms.ChannelSchedules, channel)
+	if ms.closing {
+		ms.mu.Unlock()
+		return nil
+	}
+
+	c.Stop()
+	delete(ms.channels, channel)
+
+	ms.mu.Unlock()
+
+	for _, msg := range c.flush() {
+		ms.forget(msg)
+		ms.drop(msg, ErrChannelRemoved)
+	}
 
 	return nil
 }
 
-func (ms *MessageScheduler) AddMessage(ctx MessageContext) {
-	c, ok := ms.ChannelSchedules[ctx.Channel]
-	if !ok {
-		ms.CatchAllScheduler.MessageQueue = append(ms.CatchAllScheduler.MessageQueue, &ctx)
-		return
+// AddMessage queues a message, an error is returned if the queue refused it
+//
+// Messages to channels which haven't been added, or where the bot isn't allowed to speak, are refused
+func (ms *MessageScheduler) AddMessage(ctx MessageContext) error {
+	if ctx.ID == "" {
+		ctx.ID = uuid.NewString()
+	}
+
+	if ctx.QueuedAt.IsZero() {
+		ctx.QueuedAt = time.Now()
+	}
+
+	delayed := ctx.SendAt.After(time.Now())
+	if delayed {
+		// It only enters a queue once it is due, so it doesn't jump ahead of other messages
+		ctx.QueuedAt = ctx.SendAt
+	}
+
+	// Held until the message is queued, so RemoveChannel can't remove the channel in between
+	ms.mu.Lock()
+
+	c, err := ms.speakable(ctx.Channel)
+	if err != nil {
+		ms.mu.Unlock()
+		return err
+	}
+
+	if delayed {
+		ms.delayed[ctx.ID] = &ctx
+		ms.write(storeOp{msg: ctx})
+		ms.mu.Unlock()
+
+		ms.wakeDelayLoop()
+		return nil
+	}
+
+	dropped, err := c.push(&ctx)
+	if err != nil {
+		ms.mu.Unlock()
+		return err
+	}
+
+	// Still under the lock, so it is saved before the channel loop can send and forget it
+	ms.write(storeOp{msg: ctx})
+
+	if dropped != nil {
+		ms.write(storeOp{msg: *dropped, delete: true})
 	}
 
-	c.MessageQueue = append(c.MessageQueue, &ctx)
+	ms.mu.Unlock()
+
+	if dropped != nil {
+		ms.drop(*dropped, ErrQueueFull)
+	}
+
+	return nil
 }
 
+// Run starts sending delayed messages once they are due, channels are started as they are added
+//
+// Cancelling the context given to NewMessageScheduler stops every channel right away,
+// use Shutdown to send what is left in the queues first
 func (ms *MessageScheduler) Run() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.running {
+		return
+	}
+	ms.running = true
+
 	go func() {
 		<-ms.Ctx.Done()
 
-		for _, schedule := range ms.ChannelSchedules {
-			/*
-				FIXME: This would make any messages that are currently being sent be lost
-			*/
-			schedule.Ctx.Done()
+		for _, schedule := range ms.schedules() {
+			schedule.Stop()
 		}
 	}()
 
-	// Generate a goroutine for each channel
-	for channel, schedule := range ms.ChannelSchedules {
-		zap.S().Infof("Starting message scheduler for channel %s", channel)
-		go ms.channelLoop(schedule)
+	go ms.delayLoop()
+}
+
+// Shutdown sends the remaining messages of every channel, giving up once timeout has passed
+//
+// Messages which could not be sent in time are returned, they are kept in the store for the next start
+func (ms *MessageScheduler) Shutdown(timeout time.Duration) []MessageContext {
+	ms.mu.Lock()
+	ms.closing = true
+	ms.mu.Unlock()
+
+	// Delayed messages stay in the store until the next start
+	ms.delayCancel()
+
+	schedules := ms.schedules()
+
+	for _, schedule := range schedules {
+		schedule.drain()
 	}
 
-	go ms.channelLoop(ms.CatchAllScheduler)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for _, schedule := range schedules {
+		select {
+		case <-schedule.stopped:
+		case <-deadline.C:
+			zap.S().Warnf("Message scheduler did not finish sending within %s", timeout)
+
+			// Channels which are still sending are stopped, keeping the rest of their queue
+			for _, schedule := range schedules {
+				schedule.Stop()
+			}
+		}
+	}
+
+	pending := make([]MessageContext, 0)
+	for _, schedule := range schedules {
+		<-schedule.stopped
+
+		pending = append(pending, schedule.flush()...)
+	}
+
+	ms.flushStore()
+
+	return pending
 }
 
-func (ms *MessageScheduler) channelLoop(schedule *ChannelSchedule) {
+// Returns the schedule of a channel, if the bot is allowed to speak in it, the caller has to hold ms.mu
+func (ms *MessageScheduler) speakable(channel string) (*ChannelSchedule, error) {
+	c, ok := ms.channels[channel]
+	if !ok {
+		return nil, ErrChanNotFound
+	}
 
-	/*
-		time.Ticker seems to have issues with not being accurate enough.
+	if !c.Interval().IsAllowedToSpeak() {
+		return nil, ErrReadOnly
+	}
 
-		See: https://stackoverflow.com/questions/70594795/more-accurate-ticker-than-time-newticker-in-go-on-macos/
+	return c, nil
+}
 
-		dynamically create a time.Duration to make updating the interval easier
-	*/
-	next := time.Now().Add(timeDuration(schedule.Interval))
+// Returns every schedule
+func (ms *MessageScheduler) schedules() []*ChannelSchedule {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	schedules := make([]*ChannelSchedule, 0, len(ms.channels))
+	for _, schedule := range ms.channels {
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules
+}
+
+func (ms *MessageScheduler) send(ctx MessageContext) {
+	ms.mu.RLock()
+	onMessage := ms.onMessage
+	ms.mu.RUnlock()
+
+	onMessage(ctx)
+}
+
+func (ms *MessageScheduler) drop(ctx MessageContext, reason error) {
+	ms.mu.RLock()
+	onDrop := ms.onDrop
+	ms.mu.RUnlock()
+
+	onDrop(ctx, reason)
+}
+
+func (ms *MessageScheduler) hold(ctx MessageContext, reason error) {
+	ms.mu.RLock()
+	onHold := ms.onHold
+	ms.mu.RUnlock()
+
+	onHold(ctx, reason)
+}
+
+// Deals with a channel the gate refused, false if the schedule was stopped
+//
+// Held messages stay queued until the channel is rescheduled, otherwise the next message is dropped
+func (ms *MessageScheduler) restrict(schedule *ChannelSchedule, reason error) bool {
+	for _, msg := range schedule.removeExpired() {
+		ms.forget(*msg)
+		ms.drop(*msg, ErrExpired)
+	}
+
+	if !errors.Is(reason, ErrHeld) {
+		msg, _ := schedule.pop()
+		if msg != nil {
+			ms.forget(*msg)
+			ms.drop(*msg, reason)
+		}
+
+		return true
+	}
+
+	for _, msg := range schedule.markHeld() {
+		ms.hold(msg, reason)
+	}
+
+	// Held messages can still expire
+	var (
+		timer *time.Timer
+		fire  <-chan time.Time
+	)
+
+	if deadline := schedule.nextDeadline(); !deadline.IsZero() {
+		timer = time.NewTimer(time.Until(deadline))
+		fire = timer.C
+	}
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	select {
+	case <-schedule.Ctx.Done():
+		return false
+	case <-schedule.wake:
+	case <-fire:
+	}
+
+	return true
+}
 
-	// Wait for timer or program shutdown
+// Sleeps until the queue has a message, false if the schedule was stopped or is done draining
+func (ms *MessageScheduler) waitForMessage(schedule *ChannelSchedule) bool {
+	for schedule.Len() == 0 {
+		if schedule.isDraining() {
+			return false
+		}
+
+		select {
+		case <-schedule.Ctx.Done():
+			return false
+		case <-schedule.wake:
+		}
+	}
+
+	return true
+}
+
+// Sleeps until the rate policy allows the next message, false if the schedule was stopped
+//
+// The policy can change while waiting, so it is checked again whenever the schedule is woken up
+func (ms *MessageScheduler) waitForInterval(schedule *ChannelSchedule, last time.Time) bool {
 	for {
-		time.Sleep(time.Until(next))
+		next := ms.ratePolicy().NextSend(schedule.Name, schedule.Interval(), last)
+
+		wait := time.Until(next)
+		if wait <= 0 {
+			return true
+		}
+
+		timer := time.NewTimer(wait)
 
 		select {
 		case <-schedule.Ctx.Done():
+			timer.Stop()
+			return false
+		case <-schedule.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (ms *MessageScheduler) channelLoop(schedule *ChannelSchedule) {
+	/*
+		The loop sleeps until a message is queued, so idle channels cost nothing.
+
+		A message is only sent once the rate policy allows it, the gate lets it through
+		and the global limiter has room for it.
+	*/
+	defer close(schedule.stopped)
+
+	last := time.Now()
+
+	for {
+		if !ms.waitForMessage(schedule) {
 			return
-		default:
-			{
-				/* pass */
+		}
+
+		if !ms.waitForInterval(schedule, last) {
+			return
+		}
+
+		if err := ms.check(schedule); err != nil {
+			if !ms.restrict(schedule, err) {
+				return
 			}
+
+			continue
+		}
+
+		perm := schedule.Interval()
+		if err := ms.Limiter().Wait(schedule.Ctx, perm); err != nil {
+			return
 		}
-		// Send message if there is one
-		if len(schedule.MessageQueue) > 0 {
-			ms.OnMessage(*schedule.MessageQueue[0])
-			schedule.MessageQueue = schedule.MessageQueue[1:]
+
+		msg, expired := schedule.pop()
+		for _, e := range expired {
+			ms.forget(*e)
+			ms.drop(*e, ErrExpired)
+		}
+
+		if msg == nil {
+			// Every queued message expired while waiting, so nothing used the token
+			ms.Limiter().Release(perm)
+			continue
 		}
 
-		next = next.Add(timeDuration(schedule.Interval))
+		ms.send(*msg)
+		ms.forget(*msg)
+		last = time.Now()
 	}
 }
 
@@ -2,6 +2,8 @@ package messagescheduler
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,7 +15,7 @@ func TestAddChannel(t *testing.T) {
 
 	s.AddChannel("test", dbmodels.ModeratorPermission)
 
-	if _, ok := s.ChannelSchedules["test"]; !ok {
+	if _, ok := s.Channel("test"); !ok {
 		t.Error("Channel not added")
 	}
 }
@@ -27,7 +29,7 @@ func TestRemoveChannel(t *testing.T) {
 		t.Error("Error removing channel")
 	}
 
-	if _, ok := s.ChannelSchedules["test"]; ok {
+	if _, ok := s.Channel("test"); ok {
 		t.Error("Channel not removed")
 	}
 
@@ -46,22 +48,68 @@ func TestAddMessage(t *testing.T) {
 		Message: "test",
 	})
 
-	if len(s.ChannelSchedules["test"].MessageQueue) != 1 {
+	test, _ := s.Channel("test")
+	if test.Len() != 1 {
 		t.Error("Message not added")
 	}
 
-	s.AddMessage(MessageContext{
+	err := s.AddMessage(MessageContext{
 		Channel: "test2",
 		Message: "test",
 	})
 
-	test2 := s.ChannelSchedules["test2"]
-	if test2 != nil {
-		t.Error("Channel 'test2' added to wrong queue")
+	if err != ErrChanNotFound {
+		t.Errorf("Expected ErrChanNotFound, got %v", err)
 	}
 
-	if len(s.CatchAllScheduler.MessageQueue) != 1 {
-		t.Error("Message not added to catch all")
+	if _, ok := s.Channel("test2"); ok {
+		t.Error("Channel 'test2' added by a message")
+	}
+}
+
+func TestAddMessageReadOnly(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+
+	s.AddChannel("test", dbmodels.ReadPermission)
+
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "test"}); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+
+	test, _ := s.Channel("test")
+	if test.Len() != 0 {
+		t.Error("Message added to a read only channel")
+	}
+}
+
+func TestReadOnlyDropsQueued(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+
+	dropped := make(chan error, 1)
+	s.SetOnMessage(func(ctx MessageContext) {
+		t.Error("Message sent to a read only channel")
+	})
+	s.SetOnDrop(func(ctx MessageContext, reason error) {
+		dropped <- reason
+	})
+
+	s.AddChannel("test", dbmodels.BotPermission)
+
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bot lost its permission to speak before the message was sent
+	s.UpdateTimer("test", dbmodels.ReadPermission)
+	s.Run()
+
+	select {
+	case reason := <-dropped:
+		if reason != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly, got %v", reason)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Message not dropped")
 	}
 }
 
@@ -70,7 +118,12 @@ func TestUpdateTimer(t *testing.T) {
 
 	s.AddChannel("test", dbmodels.ModeratorPermission)
 
-	s.UpdateTimer("test", dbmodels.ModeratorPermission)
+	s.UpdateTimer("test", dbmodels.VIPPermission)
+
+	test, _ := s.Channel("test")
+	if !test.IntervalIsCurrently(dbmodels.VIPPermission) {
+		t.Error("Interval not updated")
+	}
 }
 
 func TestOnMessage(t *testing.T) {
@@ -85,7 +138,7 @@ func TestOnMessage(t *testing.T) {
 	*/
 	s.AddChannel("test", perm)
 
-	fnCount := 0
+	var fnCount atomic.Int32
 	now := time.Now()
 
 	s.SetOnMessage(func(ctx MessageContext) {
@@ -105,7 +158,7 @@ func TestOnMessage(t *testing.T) {
 			t.Error("Expected time difference to be within expected interval")
 		}
 
-		fnCount++
+		fnCount.Add(1)
 		now = time.Now()
 	})
 
@@ -116,13 +169,165 @@ func TestOnMessage(t *testing.T) {
 		})
 	}
 
-	if len(s.ChannelSchedules["test"].MessageQueue) != 5 {
+	if test, _ := s.Channel("test"); test.Len() != 5 {
 		t.Error("Expected 5 messages in queue")
 	}
 
 	time.Sleep(5 * time.Second)
 
-	if fnCount != 5 {
+	if fnCount.Load() != 5 {
 		t.Error("Expected OnMessage to be called 5 times")
 	}
 }
+
+func TestIntervalIsRespected(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+	perm := dbmodels.VIPPermission
+
+	s.AddChannel("test", perm)
+
+	sent := make(chan time.Time, 10)
+	s.SetOnMessage(func(ctx MessageContext) {
+		sent <- time.Now()
+	})
+
+	for i := 0; i < 3; i++ {
+		s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+	}
+
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case at := <-sent:
+			if !last.IsZero() && at.Sub(last) < timeDuration(perm) {
+				t.Errorf("Message sent after %s, expected at least %s", at.Sub(last), timeDuration(perm))
+			}
+			last = at
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for message")
+		}
+	}
+
+	// An idle channel has to pick up a new message without waiting for a tick
+	time.Sleep(2 * timeDuration(perm))
+
+	before := time.Now()
+	s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+
+	select {
+	case at := <-sent:
+		if at.Sub(before) > timeDuration(perm)/2 {
+			t.Errorf("Idle channel took %s to send", at.Sub(before))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+func TestConcurrentAddMessage(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+
+	var count atomic.Int32
+	s.SetOnMessage(func(ctx MessageContext) {
+		count.Add(1)
+	})
+
+	s.AddChannel("test", dbmodels.BotPermission)
+
+	const (
+		senders  = 5
+		messages = 4
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < messages; j++ {
+				s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+				s.UpdateTimer("test", dbmodels.BotPermission)
+
+				if c, ok := s.Channel("test"); ok {
+					_ = c.Len()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for count.Load() != senders*messages {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d messages, got %d", senders*messages, count.Load())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoveChannelStopsLoop(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+
+	s.AddChannel("test", dbmodels.ModeratorPermission)
+	test, _ := s.Channel("test")
+
+	if err := s.RemoveChannel("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-test.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Channel loop is still running")
+	}
+
+	s.AddChannel("test", dbmodels.ModeratorPermission)
+	if readded, _ := s.Channel("test"); readded == test {
+		t.Error("Expected a new schedule")
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+
+	var count atomic.Int32
+	s.SetOnMessage(func(ctx MessageContext) {
+		count.Add(1)
+	})
+
+	s.AddChannel("test", dbmodels.BotPermission)
+	s.Run()
+
+	for i := 0; i < 3; i++ {
+		s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+	}
+
+	if pending := s.Shutdown(5 * time.Second); len(pending) != 0 {
+		t.Errorf("Expected no pending messages, got %d", len(pending))
+	}
+
+	if count.Load() != 3 {
+		t.Errorf("Expected 3 messages to be sent, got %d", count.Load())
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+
+	s.AddChannel("test", dbmodels.WritePermission)
+	s.Run()
+
+	for i := 0; i < 5; i++ {
+		s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+	}
+
+	// Write mode sends one message every 1250ms, so most of the queue is left over
+	pending := s.Shutdown(100 * time.Millisecond)
+	if len(pending) != 5 {
+		t.Errorf("Expected 5 pending messages, got %d", len(pending))
+	}
+}
@@ -0,0 +1,114 @@
+package messagescheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+// RatePolicy decides when a channel may be sent its next message
+type RatePolicy interface {
+	// NextSend returns the earliest time a message can be sent to channel,
+	// given the bot's permission in the channel and when the previous message was sent
+	NextSend(channel string, perm dbmodels.BotPermmision, last time.Time) time.Time
+}
+
+// PermissionPolicy spaces messages using the cooldown of the bot's permission in the channel
+type PermissionPolicy struct{}
+
+func (PermissionPolicy) NextSend(channel string, perm dbmodels.BotPermmision, last time.Time) time.Time {
+	return last.Add(timeDuration(perm))
+}
+
+// IntervalPolicy spaces messages by a fixed interval set for each channel, such as one a broadcaster asked for
+//
+// Channels without an interval are not limited by it
+type IntervalPolicy struct {
+	mu        sync.RWMutex
+	intervals map[string]time.Duration
+}
+
+func NewIntervalPolicy() *IntervalPolicy {
+	return &IntervalPolicy{
+		intervals: make(map[string]time.Duration),
+	}
+}
+
+// Set sets the interval of a channel, an interval of 0 removes it
+func (p *IntervalPolicy) Set(channel string, interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if interval <= 0 {
+		delete(p.intervals, channel)
+		return
+	}
+
+	p.intervals[channel] = interval
+}
+
+func (p *IntervalPolicy) NextSend(channel string, perm dbmodels.BotPermmision, last time.Time) time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return last.Add(p.intervals[channel])
+}
+
+// SlowModePolicy follows the slow mode of each channel, as sent by ROOMSTATE
+//
+// VIPs, moderators and the broadcaster are not affected by slow mode
+type SlowModePolicy struct {
+	mu   sync.RWMutex
+	slow map[string]time.Duration
+}
+
+func NewSlowModePolicy() *SlowModePolicy {
+	return &SlowModePolicy{
+		slow: make(map[string]time.Duration),
+	}
+}
+
+// Set sets the slow mode of a channel, 0 turns it off
+func (p *SlowModePolicy) Set(channel string, slow time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if slow <= 0 {
+		delete(p.slow, channel)
+		return
+	}
+
+	p.slow[channel] = slow
+}
+
+// Update follows the slow mode of a RoomState, so it stays in step with RoomStates
+func (p *SlowModePolicy) Update(channel string, state RoomState) {
+	p.Set(channel, state.Slow)
+}
+
+func (p *SlowModePolicy) NextSend(channel string, perm dbmodels.BotPermmision, last time.Time) time.Time {
+	if perm >= dbmodels.VIPPermission {
+		return last
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return last.Add(p.slow[channel])
+}
+
+// Policies combines several policies, a message is only sent once every policy allows it
+type Policies []RatePolicy
+
+func (p Policies) NextSend(channel string, perm dbmodels.BotPermmision, last time.Time) time.Time {
+	next := last
+
+	for _, policy := range p {
+		if t := policy.NextSend(channel, perm, last); t.After(next) {
+			next = t
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,107 @@
+package messagescheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestPermissionPolicy(t *testing.T) {
+	last := time.Now()
+
+	next := PermissionPolicy{}.NextSend("test", dbmodels.VIPPermission, last)
+	if next.Sub(last) != timeDuration(dbmodels.VIPPermission) {
+		t.Errorf("Expected the VIP cooldown, got %s", next.Sub(last))
+	}
+}
+
+func TestIntervalPolicy(t *testing.T) {
+	p := NewIntervalPolicy()
+	last := time.Now()
+
+	if next := p.NextSend("test", dbmodels.WritePermission, last); !next.Equal(last) {
+		t.Error("Expected a channel without an interval not to be limited")
+	}
+
+	p.Set("test", 5*time.Second)
+	if next := p.NextSend("test", dbmodels.BotPermission, last); next.Sub(last) != 5*time.Second {
+		t.Errorf("Expected a 5s interval, got %s", next.Sub(last))
+	}
+
+	p.Set("test", 0)
+	if next := p.NextSend("test", dbmodels.WritePermission, last); !next.Equal(last) {
+		t.Error("Expected the interval to be removed")
+	}
+}
+
+func TestSlowModePolicy(t *testing.T) {
+	p := NewSlowModePolicy()
+	p.Set("test", 30*time.Second)
+
+	last := time.Now()
+
+	if next := p.NextSend("test", dbmodels.WritePermission, last); next.Sub(last) != 30*time.Second {
+		t.Errorf("Expected slow mode to apply, got %s", next.Sub(last))
+	}
+
+	for _, perm := range []dbmodels.BotPermmision{dbmodels.VIPPermission, dbmodels.ModeratorPermission, dbmodels.BotPermission} {
+		if next := p.NextSend("test", perm, last); !next.Equal(last) {
+			t.Errorf("Expected %s to bypass slow mode", perm)
+		}
+	}
+
+	// Follows the room state as ROOMSTATE changes it
+	p.Update("test", RoomState{FollowersOnly: -1})
+	if next := p.NextSend("test", dbmodels.WritePermission, last); !next.Equal(last) {
+		t.Error("Expected slow mode to be turned off")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	interval := NewIntervalPolicy()
+	interval.Set("test", 2*time.Second)
+
+	p := Policies{PermissionPolicy{}, interval}
+	last := time.Now()
+
+	if next := p.NextSend("test", dbmodels.WritePermission, last); next.Sub(last) != 2*time.Second {
+		t.Errorf("Expected the longest interval, got %s", next.Sub(last))
+	}
+
+	if next := p.NextSend("other", dbmodels.WritePermission, last); next.Sub(last) != timeDuration(dbmodels.WritePermission) {
+		t.Errorf("Expected the permission cooldown, got %s", next.Sub(last))
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	interval := NewIntervalPolicy()
+	interval.Set("test", time.Hour)
+
+	s := NewMessageScheduler(context.Background())
+	s.SetRatePolicy(Policies{PermissionPolicy{}, interval})
+
+	sent := make(chan struct{}, 1)
+	s.SetOnMessage(func(ctx MessageContext) {
+		sent <- struct{}{}
+	})
+
+	s.AddChannel("test", dbmodels.BotPermission)
+	s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+
+	select {
+	case <-sent:
+		t.Fatal("Message sent before the interval passed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	interval.Set("test", 0)
+	s.Reschedule("test")
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message after rescheduling")
+	}
+}
@@ -0,0 +1,68 @@
+package messagescheduler
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPriority = errors.New("invalid priority")
+)
+
+// Priority decides which queued message of a channel is sent first
+//
+// The zero value is PriorityNormal
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+const (
+	// Tag clients set on PRIVMSG to pick a priority
+	PriorityTag = "melon-priority"
+
+	// A queued message that has waited priorityAging is treated as one priority higher, so low
+	// priority messages are sent eventually even if normal priority messages keep coming.
+	// Aging never reaches PriorityHigh, a fresh high priority message always goes first
+	priorityAging = 5 * time.Second
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePriority parses "high", "normal" or "low", an empty string is PriorityNormal
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(s) {
+	case "high":
+		return PriorityHigh, nil
+	case "normal", "":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	default:
+		return PriorityNormal, ErrInvalidPriority
+	}
+}
+
+// The priority of a message after taking into account how long it has been queued
+func effectivePriority(msg *MessageContext, now time.Time) Priority {
+	if msg.Priority >= PriorityNormal || now.Sub(msg.QueuedAt) < priorityAging {
+		return msg.Priority
+	}
+
+	return msg.Priority + 1
+}
@@ -0,0 +1,77 @@
+package messagescheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestParsePriority(t *testing.T) {
+	tests := map[string]Priority{
+		"":       PriorityNormal,
+		"low":    PriorityLow,
+		"normal": PriorityNormal,
+		"HIGH":   PriorityHigh,
+	}
+
+	for input, expected := range tests {
+		p, err := ParsePriority(input)
+		if err != nil {
+			t.Errorf("ParsePriority(%q) returned %v", input, err)
+		}
+
+		if p != expected {
+			t.Errorf("ParsePriority(%q) = %s, expected %s", input, p, expected)
+		}
+	}
+
+	if _, err := ParsePriority("urgent"); err != ErrInvalidPriority {
+		t.Errorf("Expected ErrInvalidPriority, got %v", err)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	cs := NewChannelSchedule(context.Background(), dbmodels.WritePermission)
+
+	cs.push(&MessageContext{Message: "low", Priority: PriorityLow})
+	cs.push(&MessageContext{Message: "normal 1"})
+	cs.push(&MessageContext{Message: "high", Priority: PriorityHigh})
+	cs.push(&MessageContext{Message: "normal 2"})
+
+	for _, expected := range []string{"high", "normal 1", "normal 2", "low"} {
+		msg, _ := cs.pop()
+		if msg == nil || msg.Message != expected {
+			t.Fatalf("Expected %q, got %+v", expected, msg)
+		}
+	}
+
+	if msg, _ := cs.pop(); msg != nil {
+		t.Error("Expected queue to be empty")
+	}
+}
+
+func TestPriorityAging(t *testing.T) {
+	cs := NewChannelSchedule(context.Background(), dbmodels.WritePermission)
+
+	// Waited long enough to catch up with normal priority messages, but no further
+	cs.push(&MessageContext{
+		Message:  "low",
+		Priority: PriorityLow,
+		QueuedAt: time.Now().Add(-10 * priorityAging),
+	})
+	cs.push(&MessageContext{
+		Message:  "normal 1",
+		QueuedAt: time.Now().Add(-10 * priorityAging),
+	})
+	cs.push(&MessageContext{Message: "high", Priority: PriorityHigh})
+	cs.push(&MessageContext{Message: "normal 2"})
+
+	for _, expected := range []string{"high", "low", "normal 1", "normal 2"} {
+		msg, _ := cs.pop()
+		if msg == nil || msg.Message != expected {
+			t.Fatalf("Expected %q, got %+v", expected, msg)
+		}
+	}
+}
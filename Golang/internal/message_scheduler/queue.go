@@ -0,0 +1,95 @@
+package messagescheduler
+
+import (
+	"errors"
+	"fmt"
+)
+
+// QueuePolicy decides what happens to a new message when a channel's queue is full
+type QueuePolicy int
+
+const (
+	// Refuse the new message
+	RejectNew QueuePolicy = iota
+	// Drop the oldest queued message to make room for the new one
+	DropOldest
+	// Merge a new message into an identical queued one, even if the queue isn't full.
+	// Other messages are refused once the queue is full
+	CollapseIdentical
+)
+
+const (
+	// Default amount of messages queued for a single channel
+	DefaultQueueSize = 100
+)
+
+var (
+	ErrQueueFull = errors.New("message queue is full")
+	ErrCollapsed = errors.New("an identical message is already queued")
+)
+
+// QueueLimit is the maximum length of a channel's queue and what to do once it is reached
+type QueueLimit struct {
+	// Size of 0 uses DefaultQueueSize
+	Size   int
+	Policy QueuePolicy
+}
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case RejectNew:
+		return "reject-new"
+	case DropOldest:
+		return "drop-oldest"
+	case CollapseIdentical:
+		return "collapse-identical"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseQueuePolicy parses the name of a policy, an empty string is RejectNew
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	switch name {
+	case "", "reject-new":
+		return RejectNew, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	case "collapse-identical":
+		return CollapseIdentical, nil
+	default:
+		return RejectNew, fmt.Errorf("unknown queue policy %s", name)
+	}
+}
+
+func (l QueueLimit) size() int {
+	if l.Size <= 0 {
+		return DefaultQueueSize
+	}
+
+	return l.Size
+}
+
+// Checks if two messages would end up as the same message in chat
+func identical(a, b *MessageContext) bool {
+	if a.Channel != b.Channel || a.Message != b.Message {
+		return false
+	}
+
+	if a.ReplyTo == nil || b.ReplyTo == nil {
+		return a.ReplyTo == nil && b.ReplyTo == nil
+	}
+
+	return *a.ReplyTo == *b.ReplyTo
+}
+
+// Merges msg into a queued identical message, keeping the higher priority and the later deadline
+func collapse(queued, msg *MessageContext) {
+	if msg.Priority > queued.Priority {
+		queued.Priority = msg.Priority
+	}
+
+	if msg.Deadline.IsZero() || (!queued.Deadline.IsZero() && msg.Deadline.After(queued.Deadline)) {
+		queued.Deadline = msg.Deadline
+	}
+}
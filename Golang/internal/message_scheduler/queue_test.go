@@ -0,0 +1,99 @@
+package messagescheduler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestParseQueuePolicy(t *testing.T) {
+	for _, policy := range []QueuePolicy{RejectNew, DropOldest, CollapseIdentical} {
+		parsed, err := ParseQueuePolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("ParseQueuePolicy(%q) = %s, %v", policy.String(), parsed, err)
+		}
+	}
+
+	if _, err := ParseQueuePolicy("drop-everything"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestQueueRejectNew(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+	s.SetQueueLimit(QueueLimit{Size: 2, Policy: RejectNew})
+
+	s.AddChannel("test", dbmodels.WritePermission)
+
+	for i := 0; i < 2; i++ {
+		if err := s.AddMessage(MessageContext{Channel: "test", Message: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "test"}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+	s.SetQueueLimit(QueueLimit{Size: 2, Policy: DropOldest})
+
+	var dropped []string
+	s.SetOnDrop(func(ctx MessageContext, reason error) {
+		if reason != ErrQueueFull {
+			t.Errorf("Expected ErrQueueFull, got %v", reason)
+		}
+
+		dropped = append(dropped, ctx.Message)
+	})
+
+	s.AddChannel("test", dbmodels.WritePermission)
+
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := s.AddMessage(MessageContext{Channel: "test", Message: msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(dropped) != 1 || dropped[0] != "1" {
+		t.Errorf("Expected the first message to be dropped, got %v", dropped)
+	}
+
+	test, _ := s.Channel("test")
+	if test.Len() != 2 {
+		t.Errorf("Expected 2 queued messages, got %d", test.Len())
+	}
+}
+
+func TestQueueCollapseIdentical(t *testing.T) {
+	s := NewMessageScheduler(context.Background())
+	s.SetQueueLimit(QueueLimit{Size: 2, Policy: CollapseIdentical})
+
+	s.AddChannel("test", dbmodels.WritePermission)
+
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "same"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "same", Priority: PriorityHigh}); err != ErrCollapsed {
+		t.Errorf("Expected ErrCollapsed, got %v", err)
+	}
+
+	replyTo := "abc"
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "same", ReplyTo: &replyTo}); err != nil {
+		t.Errorf("A reply is not identical to a message, got %v", err)
+	}
+
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "different"}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	test, _ := s.Channel("test")
+	msg, _ := test.pop()
+	if msg.Message != "same" || msg.ReplyTo != nil || msg.Priority != PriorityHigh {
+		t.Errorf("Expected the collapsed message to keep the higher priority, got %+v", msg)
+	}
+}
@@ -0,0 +1,201 @@
+package messagescheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+// RateLimit is the amount of messages allowed within Window
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+var (
+	// Limit for channels where the bot has no special status
+	NormalRateLimit = RateLimit{Limit: 20, Window: 30 * time.Second}
+	// Limit for channels where the bot is a moderator or the broadcaster
+	ModeratorRateLimit = RateLimit{Limit: 100, Window: 30 * time.Second}
+	// Limit for verified bots, in every channel
+	VerifiedRateLimit = RateLimit{Limit: 7500, Window: 30 * time.Second}
+)
+
+// Budget is how many messages can be sent right now without being throttled by Twitch
+type Budget struct {
+	// Messages which can be sent to channels where the bot has no special status
+	Normal int `json:"normal"`
+	// Messages which can be sent to channels where the bot is a moderator or the broadcaster
+	Moderator int `json:"moderator"`
+}
+
+/*
+GlobalLimiter is the account wide limit Twitch enforces on top of the per channel cooldowns.
+
+Messages sent to channels where the bot is a moderator count towards the moderator limit,
+every other message counts towards both the normal and the moderator limit.
+So the bot never sends more than 20 normal messages, or 100 messages in total, within 30 seconds.
+*/
+type GlobalLimiter struct {
+	mu        sync.Mutex
+	normal    *bucket
+	moderator *bucket
+}
+
+// NewGlobalLimiter creates a limiter using Twitch's limits
+func NewGlobalLimiter(verified bool) *GlobalLimiter {
+	if verified {
+		return newGlobalLimiter(VerifiedRateLimit, VerifiedRateLimit)
+	}
+
+	return newGlobalLimiter(NormalRateLimit, ModeratorRateLimit)
+}
+
+func newGlobalLimiter(normal, moderator RateLimit) *GlobalLimiter {
+	return &GlobalLimiter{
+		normal:    newBucket(normal),
+		moderator: newBucket(moderator),
+	}
+}
+
+// Returns the buckets a message sent with the given permission counts towards
+func (l *GlobalLimiter) bucketsFor(perm dbmodels.BotPermmision) []*bucket {
+	if perm == dbmodels.ModeratorPermission || perm == dbmodels.BotPermission {
+		return []*bucket{l.moderator}
+	}
+
+	return []*bucket{l.normal, l.moderator}
+}
+
+// Reserve takes a token if one is available, otherwise it returns how long to wait before trying again
+func (l *GlobalLimiter) Reserve(perm dbmodels.BotPermmision) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	buckets := l.bucketsFor(perm)
+
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.wait(now); w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	for _, b := range buckets {
+		b.take(now)
+	}
+
+	return 0
+}
+
+// Wait blocks until a message can be sent with the given permission
+func (l *GlobalLimiter) Wait(ctx context.Context, perm dbmodels.BotPermmision) error {
+	for {
+		wait := l.Reserve(perm)
+		if wait == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Release gives back a token taken with the given permission which wasn't used to send a message
+func (l *GlobalLimiter) Release(perm dbmodels.BotPermmision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, b := range l.bucketsFor(perm) {
+		b.give()
+	}
+}
+
+// Remaining returns the budget left right now
+func (l *GlobalLimiter) Remaining() Budget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	normal := l.normal.remaining(now)
+	moderator := l.moderator.remaining(now)
+
+	// Normal messages also use up the moderator limit
+	if moderator < normal {
+		normal = moderator
+	}
+
+	return Budget{
+		Normal:    normal,
+		Moderator: moderator,
+	}
+}
+
+/*
+bucket holds Limit tokens, a token comes back one Window after it was taken.
+
+Refilling at a constant rate would let a full bucket be spent and refilled within one window,
+going over the limit, so the time every token was taken is kept instead.
+*/
+type bucket struct {
+	limit RateLimit
+	// When each token in use was taken, oldest first
+	taken []time.Time
+}
+
+func newBucket(limit RateLimit) *bucket {
+	return &bucket{
+		limit: limit,
+		taken: make([]time.Time, 0, limit.Limit),
+	}
+}
+
+// Returns the tokens which have been out for a full window
+func (b *bucket) refill(now time.Time) {
+	i := 0
+	for i < len(b.taken) && !now.Before(b.taken[i].Add(b.limit.Window)) {
+		i++
+	}
+
+	b.taken = b.taken[i:]
+}
+
+func (b *bucket) remaining(now time.Time) int {
+	b.refill(now)
+
+	return b.limit.Limit - len(b.taken)
+}
+
+// How long until a token is available
+func (b *bucket) wait(now time.Time) time.Duration {
+	if b.remaining(now) > 0 {
+		return 0
+	}
+
+	return b.taken[0].Add(b.limit.Window).Sub(now)
+}
+
+func (b *bucket) take(now time.Time) {
+	b.taken = append(b.taken, now)
+}
+
+// Returns the token taken last
+func (b *bucket) give() {
+	if len(b.taken) > 0 {
+		b.taken = b.taken[:len(b.taken)-1]
+	}
+}
@@ -0,0 +1,112 @@
+package messagescheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestLimiterNormal(t *testing.T) {
+	l := newGlobalLimiter(
+		RateLimit{Limit: 2, Window: time.Hour},
+		RateLimit{Limit: 5, Window: time.Hour},
+	)
+
+	for i := 0; i < 2; i++ {
+		if wait := l.Reserve(dbmodels.WritePermission); wait != 0 {
+			t.Fatalf("Expected message %d to be allowed", i)
+		}
+	}
+
+	if wait := l.Reserve(dbmodels.WritePermission); wait == 0 {
+		t.Error("Expected normal limit to be reached")
+	}
+
+	// Normal messages count towards the moderator limit as well
+	if budget := l.Remaining(); budget.Normal != 0 || budget.Moderator != 3 {
+		t.Errorf("Unexpected budget %+v", budget)
+	}
+
+	for i := 0; i < 3; i++ {
+		if wait := l.Reserve(dbmodels.ModeratorPermission); wait != 0 {
+			t.Fatalf("Expected moderator message %d to be allowed", i)
+		}
+	}
+
+	if wait := l.Reserve(dbmodels.BotPermission); wait == 0 {
+		t.Error("Expected moderator limit to be reached")
+	}
+}
+
+func TestLimiterModeratorUsesUpNormal(t *testing.T) {
+	l := newGlobalLimiter(
+		RateLimit{Limit: 5, Window: time.Hour},
+		RateLimit{Limit: 2, Window: time.Hour},
+	)
+
+	l.Reserve(dbmodels.ModeratorPermission)
+	l.Reserve(dbmodels.ModeratorPermission)
+
+	if wait := l.Reserve(dbmodels.WritePermission); wait == 0 {
+		t.Error("Expected normal message to be limited by the moderator limit")
+	}
+
+	if budget := l.Remaining(); budget.Normal != 0 {
+		t.Errorf("Expected no normal budget, got %d", budget.Normal)
+	}
+}
+
+func TestLimiterRelease(t *testing.T) {
+	l := newGlobalLimiter(
+		RateLimit{Limit: 1, Window: time.Hour},
+		RateLimit{Limit: 2, Window: time.Hour},
+	)
+
+	l.Reserve(dbmodels.WritePermission)
+	l.Release(dbmodels.WritePermission)
+
+	if budget := l.Remaining(); budget.Normal != 1 || budget.Moderator != 2 {
+		t.Errorf("Expected the released token to be back, got %+v", budget)
+	}
+
+	if wait := l.Reserve(dbmodels.WritePermission); wait != 0 {
+		t.Errorf("Expected the released token to be usable, waited %s", wait)
+	}
+}
+
+func TestLimiterWindow(t *testing.T) {
+	window := 100 * time.Millisecond
+	l := newGlobalLimiter(
+		RateLimit{Limit: 2, Window: window},
+		RateLimit{Limit: 2, Window: window},
+	)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := l.Wait(context.Background(), dbmodels.WritePermission); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last two messages have to wait for the first two to leave the window
+	if elapsed := time.Since(start); elapsed < window {
+		t.Errorf("Expected to wait at least %s, waited %s", window, elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := l.Wait(ctx, dbmodels.WritePermission); err == nil {
+		t.Error("Expected Wait to fail once the context is cancelled")
+	}
+}
+
+func TestVerifiedLimiter(t *testing.T) {
+	budget := NewGlobalLimiter(true).Remaining()
+
+	if budget.Normal != VerifiedRateLimit.Limit || budget.Moderator != VerifiedRateLimit.Limit {
+		t.Errorf("Unexpected verified budget %+v", budget)
+	}
+}
@@ -0,0 +1,246 @@
+package messagescheduler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+var (
+	// Wraps the reason a message is kept in the queue instead of being sent
+	ErrHeld = errors.New("message held")
+
+	ErrEmoteOnly     = errors.New("channel is in emote-only mode")
+	ErrFollowersOnly = errors.New("channel is in followers-only mode")
+	ErrSubsOnly      = errors.New("channel is in subscribers-only mode")
+)
+
+// Gate decides if a channel can be sent messages right now, where a RatePolicy only decides when
+type Gate interface {
+	// Check returns nil if a message can be sent, an error wrapping ErrHeld to keep messages queued
+	// until the scheduler is told to reschedule the channel, or any other error to drop the message
+	Check(channel string, perm dbmodels.BotPermmision) error
+}
+
+// RoomState is the state of a channel as sent by ROOMSTATE
+type RoomState struct {
+	EmoteOnly bool `json:"emote_only"`
+	// -1 if followers-only mode is off, otherwise how many minutes a user has to have followed for
+	FollowersOnly int           `json:"followers_only"`
+	SubsOnly      bool          `json:"subs_only"`
+	Slow          time.Duration `json:"slow"`
+}
+
+// Restriction returns the first mode which might keep the bot from sending messages, nil if there is none
+func (r RoomState) Restriction(perm dbmodels.BotPermmision) error {
+	if modes := r.Restrictions(perm); len(modes) > 0 {
+		return modes[0]
+	}
+
+	return nil
+}
+
+// Restrictions returns every mode which might keep the bot from sending messages
+//
+// Moderators and the broadcaster are not affected by any mode, VIPs only by emote-only mode.
+// Whether the bot follows or is subscribed to the channel isn't known, so a mode only
+// actually restricts the bot once Twitch has refused a message because of it.
+func (r RoomState) Restrictions(perm dbmodels.BotPermmision) []error {
+	if perm >= dbmodels.ModeratorPermission {
+		return nil
+	}
+
+	var modes []error
+
+	// Messages aren't checked for emotes, so every message is assumed to contain text
+	if r.EmoteOnly {
+		modes = append(modes, ErrEmoteOnly)
+	}
+
+	if perm >= dbmodels.VIPPermission {
+		return modes
+	}
+
+	if r.SubsOnly {
+		modes = append(modes, ErrSubsOnly)
+	}
+
+	if r.FollowersOnly >= 0 {
+		modes = append(modes, ErrFollowersOnly)
+	}
+
+	return modes
+}
+
+// Turns a mode on, for when Twitch says it's on before a ROOMSTATE did
+func (r *RoomState) enable(mode error) {
+	switch mode {
+	case ErrEmoteOnly:
+		r.EmoteOnly = true
+	case ErrSubsOnly:
+		r.SubsOnly = true
+	case ErrFollowersOnly:
+		if r.FollowersOnly < 0 {
+			r.FollowersOnly = 0
+		}
+	}
+}
+
+// Checks if a mode is on
+func (r RoomState) enabled(mode error) bool {
+	switch mode {
+	case ErrEmoteOnly:
+		return r.EmoteOnly
+	case ErrSubsOnly:
+		return r.SubsOnly
+	case ErrFollowersOnly:
+		return r.FollowersOnly >= 0
+	default:
+		return false
+	}
+}
+
+// ParseRestrictedAction parses what to do with messages while a channel is restricted,
+// true means drop them, an empty string holds them
+func ParseRestrictedAction(name string) (bool, error) {
+	switch name {
+	case "", "hold":
+		return false, nil
+	case "drop":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown restricted room action %s", name)
+	}
+}
+
+/*
+RoomStates keeps track of the ROOMSTATE of every channel.
+
+It is a Gate holding, or dropping if Drop is set, messages while the channel is in a mode the bot can't send messages in.
+A mode only counts once Twitch has refused a message because of it, see Refused,
+as following or subscribing to the channel exempts the bot.
+*/
+type RoomStates struct {
+	// Drop messages instead of holding them while a channel is restricted
+	Drop bool
+
+	mu    sync.RWMutex
+	rooms map[string]RoomState
+	// Modes Twitch refused a message for, until they are turned off
+	refused map[string]map[error]struct{}
+}
+
+func NewRoomStates(drop bool) *RoomStates {
+	return &RoomStates{
+		Drop:    drop,
+		rooms:   make(map[string]RoomState),
+		refused: make(map[string]map[error]struct{}),
+	}
+}
+
+// Update applies the tags of a ROOMSTATE, which might only contain what changed
+func (r *RoomStates) Update(channel string, tags map[string]string) RoomState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, ok := r.rooms[channel]
+	if !ok {
+		state.FollowersOnly = -1
+	}
+
+	if v, ok := tags["emote-only"]; ok {
+		state.EmoteOnly = v == "1"
+	}
+
+	if v, ok := tags["followers-only"]; ok {
+		if minutes, err := strconv.Atoi(v); err == nil {
+			state.FollowersOnly = minutes
+		}
+	}
+
+	if v, ok := tags["subs-only"]; ok {
+		state.SubsOnly = v == "1"
+	}
+
+	if v, ok := tags["slow"]; ok {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			state.Slow = time.Duration(seconds) * time.Second
+		}
+	}
+
+	r.rooms[channel] = state
+
+	// The bot has to be refused again once a mode has been turned off and on again
+	for mode := range r.refused[channel] {
+		if !state.enabled(mode) {
+			delete(r.refused[channel], mode)
+		}
+	}
+
+	return state
+}
+
+// Refused records that Twitch refused a message because of mode, which restricts the channel until the mode is turned off
+func (r *RoomStates) Refused(channel string, mode error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, ok := r.rooms[channel]
+	if !ok {
+		state.FollowersOnly = -1
+	}
+
+	state.enable(mode)
+	r.rooms[channel] = state
+
+	if r.refused[channel] == nil {
+		r.refused[channel] = make(map[error]struct{})
+	}
+
+	r.refused[channel][mode] = struct{}{}
+}
+
+// Get returns the state of a channel
+func (r *RoomStates) Get(channel string) (RoomState, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	state, ok := r.rooms[channel]
+	return state, ok
+}
+
+// Forget removes a channel once it has been left
+func (r *RoomStates) Forget(channel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.rooms, channel)
+	delete(r.refused, channel)
+}
+
+// Returns the first mode restricting the bot which Twitch refused a message for
+func (r *RoomStates) restriction(channel string, perm dbmodels.BotPermmision) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, mode := range r.rooms[channel].Restrictions(perm) {
+		if _, ok := r.refused[channel][mode]; ok {
+			return mode
+		}
+	}
+
+	return nil
+}
+
+func (r *RoomStates) Check(channel string, perm dbmodels.BotPermmision) error {
+	err := r.restriction(channel, perm)
+	if err == nil || r.Drop {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrHeld, err)
+}
@@ -0,0 +1,219 @@
+package messagescheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+func TestRoomStateUpdate(t *testing.T) {
+	r := NewRoomStates(false)
+
+	state := r.Update("test", map[string]string{
+		"emote-only":     "0",
+		"followers-only": "-1",
+		"subs-only":      "0",
+		"slow":           "0",
+	})
+
+	if state.EmoteOnly || state.FollowersOnly != -1 || state.SubsOnly || state.Slow != 0 {
+		t.Errorf("Unexpected state %+v", state)
+	}
+
+	// Partial updates only change what they contain
+	state = r.Update("test", map[string]string{"slow": "30"})
+	if state.Slow != 30*time.Second || state.FollowersOnly != -1 {
+		t.Errorf("Unexpected state after partial update %+v", state)
+	}
+
+	r.Forget("test")
+	if _, ok := r.Get("test"); ok {
+		t.Error("Expected the channel to be forgotten")
+	}
+}
+
+func TestRoomStateRestriction(t *testing.T) {
+	tests := []struct {
+		state    RoomState
+		perm     dbmodels.BotPermmision
+		expected error
+	}{
+		{RoomState{FollowersOnly: -1}, dbmodels.WritePermission, nil},
+		{RoomState{FollowersOnly: -1, EmoteOnly: true}, dbmodels.WritePermission, ErrEmoteOnly},
+		{RoomState{FollowersOnly: -1, EmoteOnly: true}, dbmodels.VIPPermission, ErrEmoteOnly},
+		{RoomState{FollowersOnly: -1, EmoteOnly: true}, dbmodels.ModeratorPermission, nil},
+		{RoomState{FollowersOnly: -1, SubsOnly: true}, dbmodels.WritePermission, ErrSubsOnly},
+		{RoomState{FollowersOnly: -1, SubsOnly: true}, dbmodels.VIPPermission, nil},
+		{RoomState{FollowersOnly: 10}, dbmodels.WritePermission, ErrFollowersOnly},
+		{RoomState{FollowersOnly: 0}, dbmodels.VIPPermission, nil},
+		{RoomState{FollowersOnly: 0, SubsOnly: true, EmoteOnly: true}, dbmodels.BotPermission, nil},
+	}
+
+	for _, test := range tests {
+		if err := test.state.Restriction(test.perm); err != test.expected {
+			t.Errorf("%+v as %s: expected %v, got %v", test.state, test.perm, test.expected, err)
+		}
+	}
+}
+
+func TestRoomStateRestrictions(t *testing.T) {
+	state := RoomState{FollowersOnly: 0, SubsOnly: true, EmoteOnly: true}
+
+	modes := state.Restrictions(dbmodels.WritePermission)
+	if len(modes) != 3 || modes[0] != ErrEmoteOnly || modes[1] != ErrSubsOnly || modes[2] != ErrFollowersOnly {
+		t.Errorf("Unexpected restrictions %v", modes)
+	}
+}
+
+func TestParseRestrictedAction(t *testing.T) {
+	tests := []struct {
+		name string
+		drop bool
+	}{
+		{"", false},
+		{"hold", false},
+		{"drop", true},
+	}
+
+	for _, test := range tests {
+		drop, err := ParseRestrictedAction(test.name)
+		if err != nil || drop != test.drop {
+			t.Errorf("ParseRestrictedAction(%q) = %t, %v", test.name, drop, err)
+		}
+	}
+
+	if _, err := ParseRestrictedAction("Drop"); err == nil {
+		t.Error("Expected an error for an unknown action")
+	}
+}
+
+func TestRoomStateCheck(t *testing.T) {
+	r := NewRoomStates(true)
+	r.Update("test", map[string]string{"followers-only": "10", "subs-only": "0"})
+
+	// The bot might follow the channel, so nothing is restricted until Twitch says so
+	if err := r.Check("test", dbmodels.WritePermission); err != nil {
+		t.Errorf("Expected no restriction before a refusal, got %v", err)
+	}
+
+	r.Refused("test", ErrFollowersOnly)
+
+	if err := r.Check("test", dbmodels.WritePermission); err != ErrFollowersOnly {
+		t.Errorf("Expected ErrFollowersOnly after a refusal, got %v", err)
+	}
+
+	// Being refused for one mode doesn't confirm another
+	r.Update("test", map[string]string{"subs-only": "1"})
+	r.Update("test", map[string]string{"followers-only": "-1"})
+
+	if err := r.Check("test", dbmodels.WritePermission); err != nil {
+		t.Errorf("Expected the restriction to end with followers-only mode, got %v", err)
+	}
+
+	// Turning the mode on again needs another refusal
+	r.Update("test", map[string]string{"followers-only": "0"})
+
+	if err := r.Check("test", dbmodels.WritePermission); err != nil {
+		t.Errorf("Expected no restriction until refused again, got %v", err)
+	}
+
+	// A refusal before any ROOMSTATE turns the mode on
+	r.Refused("other", ErrEmoteOnly)
+
+	if state, _ := r.Get("other"); !state.EmoteOnly || state.FollowersOnly != -1 {
+		t.Errorf("Unexpected state after a refusal %+v", state)
+	}
+
+	if err := r.Check("other", dbmodels.VIPPermission); err != ErrEmoteOnly {
+		t.Errorf("Expected ErrEmoteOnly, got %v", err)
+	}
+
+	if err := r.Check("other", dbmodels.ModeratorPermission); err != nil {
+		t.Errorf("Expected moderators to be exempt, got %v", err)
+	}
+
+	r.Forget("other")
+
+	if err := r.Check("other", dbmodels.VIPPermission); err != nil {
+		t.Errorf("Expected the refusal to be forgotten, got %v", err)
+	}
+}
+
+func TestHeldUntilModeEnds(t *testing.T) {
+	rooms := NewRoomStates(false)
+	rooms.Update("test", map[string]string{"emote-only": "1"})
+	rooms.Refused("test", ErrEmoteOnly)
+
+	s := NewMessageScheduler(context.Background())
+	s.SetGate(rooms)
+
+	sent := make(chan struct{}, 1)
+	held := make(chan error, 10)
+
+	s.SetOnMessage(func(ctx MessageContext) {
+		sent <- struct{}{}
+	})
+	s.SetOnHold(func(ctx MessageContext, reason error) {
+		held <- reason
+	})
+
+	// VIPs are still affected by emote-only mode
+	s.AddChannel("test", dbmodels.VIPPermission)
+	s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+
+	select {
+	case reason := <-held:
+		if !errors.Is(reason, ErrHeld) || !errors.Is(reason, ErrEmoteOnly) {
+			t.Errorf("Expected the message to be held for emote-only, got %v", reason)
+		}
+	case <-sent:
+		t.Fatal("Message sent in emote-only mode")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message to be held")
+	}
+
+	rooms.Update("test", map[string]string{"emote-only": "0"})
+	s.Reschedule("test")
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the held message")
+	}
+
+	if len(held) != 0 {
+		t.Error("Expected the sender to be told only once")
+	}
+}
+
+func TestDroppedWhileRestricted(t *testing.T) {
+	rooms := NewRoomStates(true)
+	rooms.Update("test", map[string]string{"subs-only": "1"})
+	rooms.Refused("test", ErrSubsOnly)
+
+	s := NewMessageScheduler(context.Background())
+	s.SetGate(rooms)
+	s.SetOnMessage(func(ctx MessageContext) {
+		t.Error("Message sent in subs-only mode")
+	})
+
+	dropped := make(chan error, 1)
+	s.SetOnDrop(func(ctx MessageContext, reason error) {
+		dropped <- reason
+	})
+
+	s.AddChannel("test", dbmodels.WritePermission)
+	s.AddMessage(MessageContext{Channel: "test", Message: "test"})
+
+	select {
+	case reason := <-dropped:
+		if reason != ErrSubsOnly {
+			t.Errorf("Expected ErrSubsOnly, got %v", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message to be dropped")
+	}
+}
@@ -0,0 +1,90 @@
+package messagescheduler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	// Hash holding every queued message, keyed by MessageContext.ID
+	RedisQueueKey redis.Key = "Firehose:MessageQueue"
+)
+
+const (
+	// Store writes waiting to be done, further writes are discarded once it's full
+	storeQueueSize = 1024
+)
+
+// Store keeps queued messages around so they survive a restart
+type Store interface {
+	// Save stores a message, replacing any message with the same ID
+	Save(context.Context, MessageContext) error
+	// Delete removes a message once it has been sent or dropped
+	Delete(ctx context.Context, id string) error
+	// Load returns every stored message
+	Load(context.Context) ([]MessageContext, error)
+}
+
+// RedisStore stores messages in a redis hash
+type RedisStore struct {
+	redis redis.Instance
+}
+
+func NewRedisStore(r redis.Instance) *RedisStore {
+	return &RedisStore{
+		redis: r,
+	}
+}
+
+func (s *RedisStore) Save(ctx context.Context, msg MessageContext) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.HSet(ctx, RedisQueueKey, msg.ID, string(data))
+}
+
+func (s *RedisStore) Delete(ctx context.Context, id string) error {
+	return s.redis.HDel(ctx, RedisQueueKey, id)
+}
+
+func (s *RedisStore) Load(ctx context.Context) ([]MessageContext, error) {
+	stored, err := s.redis.HGetAll(ctx, RedisQueueKey)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]MessageContext, 0, len(stored))
+	for id, data := range stored {
+		var msg MessageContext
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			zap.S().Warnw("Removing unreadable stored message", "id", id, "error", err)
+			_ = s.Delete(ctx, id)
+			continue
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// Used when no store is set
+type noopStore struct{}
+
+func (noopStore) Save(context.Context, MessageContext) error     { return nil }
+func (noopStore) Delete(context.Context, string) error           { return nil }
+func (noopStore) Load(context.Context) ([]MessageContext, error) { return nil, nil }
+
+// A write waiting to be done by the scheduler's store loop
+type storeOp struct {
+	store  Store
+	msg    MessageContext
+	delete bool
+	// Closed once every earlier write is done, set on ops which only wait
+	done chan struct{}
+}
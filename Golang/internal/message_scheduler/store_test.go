@@ -0,0 +1,258 @@
+package messagescheduler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JoachimFlottorp/Melonbot/Golang/internal/models/dbmodels"
+)
+
+type memoryStore struct {
+	mu   sync.Mutex
+	msgs map[string]MessageContext
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		msgs: make(map[string]MessageContext),
+	}
+}
+
+func (s *memoryStore) Save(_ context.Context, msg MessageContext) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.msgs[msg.ID] = msg
+	return nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.msgs, id)
+	return nil
+}
+
+func (s *memoryStore) Load(context.Context) ([]MessageContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := make([]MessageContext, 0, len(s.msgs))
+	for _, msg := range s.msgs {
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func (s *memoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.msgs)
+}
+
+func TestStoreKeepsUnsentMessages(t *testing.T) {
+	store := newMemoryStore()
+
+	s := NewMessageScheduler(context.Background())
+	s.SetStore(store)
+	s.SetQueueLimit(QueueLimit{Size: 1, Policy: RejectNew})
+
+	s.AddChannel("test", dbmodels.WritePermission)
+	s.Run()
+
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected messages are not kept
+	if err := s.AddMessage(MessageContext{Channel: "test", Message: "test"}); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+
+	s.flushStore()
+
+	if store.Len() != 1 {
+		t.Fatalf("Expected 1 stored message, got %d", store.Len())
+	}
+
+	// Shutting down before the message could be sent leaves it in the store
+	if pending := s.Shutdown(10 * time.Millisecond); len(pending) != 1 {
+		t.Errorf("Expected 1 pending message, got %d", len(pending))
+	}
+
+	if store.Len() != 1 {
+		t.Errorf("Expected the unsent message to stay stored, got %d", store.Len())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	store := newMemoryStore()
+
+	store.Save(context.Background(), MessageContext{ID: "1", Channel: "test", Message: "first", QueuedAt: time.Now().Add(-time.Minute)})
+	store.Save(context.Background(), MessageContext{ID: "2", Channel: "test", Message: "second", QueuedAt: time.Now()})
+	store.Save(context.Background(), MessageContext{ID: "3", Channel: "test", Message: "expired", Deadline: time.Now().Add(-time.Second)})
+
+	s := NewMessageScheduler(context.Background())
+	s.SetStore(store)
+
+	sent := make(chan string, 10)
+	s.SetOnMessage(func(ctx MessageContext) {
+		sent <- ctx.Message
+	})
+
+	if err := s.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.flushStore()
+
+	if store.Len() != 2 {
+		t.Errorf("Expected the expired message to be discarded, %d stored", store.Len())
+	}
+
+	// Restored messages wait for their channel
+	s.AddChannel("test", dbmodels.BotPermission)
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case msg := <-sent:
+			if msg != expected {
+				t.Errorf("Expected %q, got %q", expected, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for restored message")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected sent messages to be removed from the store, %d stored", store.Len())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoveChannelWhileShuttingDown(t *testing.T) {
+	store := newMemoryStore()
+
+	s := NewMessageScheduler(context.Background())
+	s.SetStore(store)
+
+	var dropped atomic.Int32
+	s.SetOnDrop(func(ctx MessageContext, reason error) {
+		dropped.Add(1)
+	})
+
+	s.AddChannel("test", dbmodels.WritePermission)
+	s.Run()
+
+	for i := 0; i < 3; i++ {
+		if err := s.AddMessage(MessageContext{Channel: "test", Message: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending := make(chan []MessageContext, 1)
+	go func() {
+		pending <- s.Shutdown(200 * time.Millisecond)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.RLock()
+		closing := s.closing
+		s.mu.RUnlock()
+
+		if closing {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for Shutdown")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// Clients disconnecting while shutting down depart their channels
+	if err := s.RemoveChannel("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write mode sends one message every 1250ms, so nothing is sent before the deadline
+	if msgs := <-pending; len(msgs) != 3 {
+		t.Errorf("Expected 3 pending messages, got %d", len(msgs))
+	}
+
+	if dropped.Load() != 0 {
+		t.Errorf("Expected no messages to be dropped, %d were", dropped.Load())
+	}
+
+	if store.Len() != 3 {
+		t.Errorf("Expected the unsent messages to stay stored, got %d", store.Len())
+	}
+}
+
+func TestRestoreTimeout(t *testing.T) {
+	store := newMemoryStore()
+
+	store.Save(context.Background(), MessageContext{ID: "1", Channel: "test", Message: "kept", QueuedAt: time.Now()})
+	store.Save(context.Background(), MessageContext{ID: "2", Channel: "gone", Message: "dropped", QueuedAt: time.Now()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewMessageScheduler(ctx)
+	s.SetStore(store)
+	s.SetRestoreTimeout(50 * time.Millisecond)
+
+	dropped := make(chan MessageContext, 10)
+	s.SetOnDrop(func(ctx MessageContext, reason error) {
+		if reason != ErrChanNotFound {
+			t.Errorf("Expected ErrChanNotFound, got %v", reason)
+		}
+
+		dropped <- ctx
+	})
+
+	// Write mode waits 1250ms before the first message, so the message of the added channel stays stored
+	s.AddChannel("test", dbmodels.WritePermission)
+
+	if err := s.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-dropped:
+		if msg.ID != "2" {
+			t.Errorf("Expected the message to the channel which was never added to be dropped, got %s", msg.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the restored message to be dropped")
+	}
+
+	s.flushStore()
+
+	if _, ok := store.msgs["2"]; ok {
+		t.Error("Expected the dropped message to be removed from the store")
+	}
+
+	if store.Len() != 1 {
+		t.Errorf("Expected 1 stored message, got %d", store.Len())
+	}
+
+	// A channel added after the timeout gets nothing
+	s.AddChannel("gone", dbmodels.BotPermission)
+
+	if c, _ := s.Channel("gone"); c.Len() != 0 {
+		t.Errorf("Expected no restored messages, got %d", c.Len())
+	}
+}
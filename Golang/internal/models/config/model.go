@@ -11,10 +11,6 @@ import (
 
 var cfg = flag.String("config", "./../config.json", "config file")
 
-func init() {
-	flag.Parse()
-}
-
 type Config struct {
 	Twitch TwitchConfig `json:"Twitch"`
 	SQL    struct {
@@ -50,9 +46,67 @@ type ServicesConfig struct {
 	Firehose struct {
 		Port       int `json:"Port"`
 		HealthPort int `json:"HealthPort"`
+		// Address the plaintext listener binds to, defaults to every interface
+		Host string `json:"Host"`
+		// Optional TLS listener, disabled if Port is 0
+		TLS struct {
+			Port int    `json:"Port"`
+			Host string `json:"Host"`
+			// Paths to the PEM encoded certificate and key, reloaded on SIGHUP
+			Cert string `json:"Cert"`
+			Key  string `json:"Key"`
+		} `json:"TLS"`
+		// Optional WebSocket listener carrying IRC lines, disabled if Port is 0
+		WebSocket struct {
+			Port int    `json:"Port"`
+			Host string `json:"Host"`
+			// Use the certificate from TLS
+			TLS bool `json:"TLS"`
+		} `json:"WebSocket"`
+		// Maximum amount of channels joined on a single upstream TMI connection
+		ChannelsPerConnection int `json:"ChannelsPerConnection"`
+		// Amount of messages queued for a single client before ClientOverflowPolicy applies
+		ClientQueueSize int `json:"ClientQueueSize"`
+		// What to do with a client which can't keep up, "drop-oldest", "drop-newest" or "disconnect"
+		ClientOverflowPolicy string `json:"ClientOverflowPolicy"`
+		// Maximum amount of connected clients across every listener, 0 is unlimited
+		ClientMaxConnections int `json:"ClientMaxConnections"`
+		// Maximum amount of messages queued for a single channel
+		ChannelQueue QueueLimit `json:"ChannelQueue"`
+		// What to do with messages to a channel in a mode the bot can't send messages in, "hold" or "drop"
+		RestrictedRoomAction string `json:"RestrictedRoomAction"`
+		// Token Melonbot itself authenticates with using PASS, it has no restrictions
+		Token string `json:"Token"`
+		// MessageTTL for the client using Token
+		MessageTTL int `json:"MessageTTL"`
+		// Additional clients allowed to connect
+		Clients []FirehoseClient `json:"Clients"`
+		// Bearer token required by the HTTP API on the health port, the API is disabled if empty
+		APIToken string `json:"APIToken"`
 	} `json:"Firehose"`
 }
 
+// QueueLimit limits the length of a message queue
+type QueueLimit struct {
+	// 0 uses the default size
+	Size int `json:"Size"`
+	// What to do with a new message once the queue is full, "reject-new", "drop-oldest" or "collapse-identical"
+	Policy string `json:"Policy"`
+}
+
+// FirehoseClient is a client allowed to connect to Firehose
+type FirehoseClient struct {
+	// Name is only used for logging
+	Name  string `json:"Name"`
+	Token string `json:"Token"`
+	// The client is not allowed to send messages
+	ReadOnly bool `json:"ReadOnly"`
+	// Channels the client is allowed to join and send messages to, empty allows every channel
+	Channels []string `json:"Channels"`
+	// Milliseconds a message from this client may wait in the queue before it's dropped, 0 never drops
+	MessageTTL int `json:"MessageTTL"`
+}
+
 func createLogConfig(isDebug bool) *zap.Config {
 	config := &zap.Config{
 		Encoding:         "console",
@@ -73,6 +127,11 @@ func createLogConfig(isDebug bool) *zap.Config {
 }
 
 func ReadConfig() (*Config, error) {
+	// Parsed here instead of in init, which would break go test's own flags
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+
 	fileDesc, err := os.Open(*cfg)
 	if err != nil {
 		return nil, err
@@ -1,5 +1,7 @@
 package dbmodels
 
+import "time"
+
 type BotPermmision int
 
 func (b BotPermmision) String() string {
@@ -33,6 +35,11 @@ func (b BotPermmision) ToMessageCooldown() int {
 	}
 }
 
+// Determines if a bot with this permission level is allowed to speak
+func (b BotPermmision) IsAllowedToSpeak() bool {
+	return b != ReadPermission
+}
+
 const (
 	// The bot is not allowed to write nor react to messages in the channel
 	ReadPermission BotPermmision = 0
@@ -53,6 +60,8 @@ type ChannelTable struct {
 	Name          string `gorm:"column:name"`
 	UserID        string `gorm:"column:user_id"`
 	BotPermission int    `gorm:"column:bot_permission"`
+	// Milliseconds between messages the broadcaster asked for, nil uses the bot permission alone
+	MessageInterval *int `gorm:"column:message_interval"`
 }
 
 func (ChannelTable) TableName() string {
@@ -65,5 +74,14 @@ func (c *ChannelTable) GetBotPermission() BotPermmision {
 
 // Determines if a bot is allowed to speak based on the bot permission level
 func (c *ChannelTable) IsAllowedToSpeak() bool {
-	return c.GetBotPermission() != ReadPermission
+	return c.GetBotPermission().IsAllowedToSpeak()
+}
+
+// Returns the interval between messages the broadcaster asked for, 0 if there is none
+func (c *ChannelTable) GetMessageInterval() time.Duration {
+	if c.MessageInterval == nil {
+		return 0
+	}
+
+	return time.Duration(*c.MessageInterval) * time.Millisecond
 }
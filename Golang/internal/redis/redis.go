@@ -11,6 +11,8 @@ import (
 
 const (
 	PubKeyEventSub Key = "EventSub"
+	// State changes of messages sent through Firehose
+	PubKeyMessageLifecycle Key = "MessageLifecycle"
 
 	Prefix = "Melonbot:"
 
@@ -51,6 +53,16 @@ type Instance interface {
 	Del(context.Context, Key) error
 	// Expire sets the expiration of the key
 	Expire(context.Context, Key, time.Duration) error
+	// SetAndPublish sets the value of the key, expiring after the given duration,
+	// and publishes data to a channel like Publish, in a single round trip
+	SetAndPublish(ctx context.Context, key Key, value string, expiration time.Duration, channel Key, data PubJSON) error
+
+	// HSet sets a field in the hash stored at key
+	HSet(context.Context, Key, string, string) error
+	// HDel deletes a field from the hash stored at key
+	HDel(context.Context, Key, string) error
+	// HGetAll returns every field and value in the hash stored at key
+	HGetAll(context.Context, Key) (map[string]string, error)
 
 	// Subscribe subscribes to a channel and returns a channel
 	Subscribe(context.Context, Key) chan PubMessage
@@ -123,6 +135,34 @@ func (r *redisInstance) Expire(ctx context.Context, key Key, expiration time.Dur
 	return r.client.Expire(ctx, r.formatKey(key), expiration).Err()
 }
 
+func (r *redisInstance) SetAndPublish(ctx context.Context, key Key, value string, expiration time.Duration, channel Key, data PubJSON) error {
+	s, err := serializeSendEvent(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.formatKey(key), value, expiration)
+		pipe.Publish(ctx, r.Prefix()+channel.String(), s)
+
+		return nil
+	})
+
+	return err
+}
+
+func (r *redisInstance) HSet(ctx context.Context, key Key, field, value string) error {
+	return r.client.HSet(ctx, r.formatKey(key), field, value).Err()
+}
+
+func (r *redisInstance) HDel(ctx context.Context, key Key, field string) error {
+	return r.client.HDel(ctx, r.formatKey(key), field).Err()
+}
+
+func (r *redisInstance) HGetAll(ctx context.Context, key Key) (map[string]string, error) {
+	return r.client.HGetAll(ctx, r.formatKey(key)).Result()
+}
+
 func (r *redisInstance) Publish(ctx context.Context, channel Key, data PubJSON) error {
 	s, err := serializeSendEvent(data)
 	if err != nil {
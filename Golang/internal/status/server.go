@@ -15,6 +15,7 @@ import (
 // The endpoint is /health and returns the status.Status object
 type Server struct {
 	listener net.Listener
+	mux      *http.ServeMux
 }
 
 // NewServer creates a new status server
@@ -26,9 +27,15 @@ func NewServer(port uint16) (*Server, error) {
 
 	return &Server{
 		listener: listener,
+		mux:      http.NewServeMux(),
 	}, nil
 }
 
+// Handle registers an additional route, it has to be called before Start
+func (s *Server) Handle(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
 // Start starts the status server
 //
 // This is a blocking operation
@@ -39,10 +46,9 @@ func (s *Server) Start(ctx context.Context) error {
 		s.listener.Close()
 	}()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", s.healthRoute)
+	s.mux.HandleFunc("/health", s.healthRoute)
 
-	return http.Serve(s.listener, mux)
+	return http.Serve(s.listener, s.mux)
 }
 
 func (s *Server) healthRoute(w http.ResponseWriter, r *http.Request) {
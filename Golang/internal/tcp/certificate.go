@@ -0,0 +1,63 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// CertificateLoader loads a TLS certificate from disk,
+// allowing it to be replaced while the server is running
+type CertificateLoader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertificateLoader creates a loader and loads the certificate once
+func NewCertificateLoader(certFile, keyFile string) (*CertificateLoader, error) {
+	l := &CertificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reload reads the certificate and key from disk again
+//
+// The previous certificate is kept if loading fails
+func (l *CertificateLoader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cert = &cert
+
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (l *CertificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.cert, nil
+}
+
+// TLSConfig creates a tls.Config which always uses the latest loaded certificate
+func (l *CertificateLoader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: l.GetCertificate,
+	}
+}
@@ -0,0 +1,175 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// CapabilityFirehose makes a connection receive messages from every joined channel,
+	// not only the ones it has joined itself
+	CapabilityFirehose = "melonbot/firehose"
+)
+
+// Conn is a client connected to the server, no matter which transport it uses
+type Conn interface {
+	// ID uniquely identifies the connection for the lifetime of the server
+	ID() uint64
+
+	// ReadString reads a single line from the client
+	ReadString() (string, error)
+	// WriteString queues one or more lines to be written to the client
+	//
+	// What happens when the queue is full depends on the OverflowPolicy of the server
+	WriteString(msg string) error
+	// Close closes the connection
+	Close() error
+	// RemoteAddr returns the address of the client
+	RemoteAddr() net.Addr
+
+	// JoinChannel subscribes the connection to messages from a channel
+	JoinChannel(channel string)
+	// PartChannel unsubscribes the connection from a channel
+	PartChannel(channel string)
+	// IsJoined checks if the connection has joined a channel
+	IsJoined(channel string) bool
+	// Channels returns every channel the connection has joined
+	Channels() []string
+	// WantsChannel checks if the connection should receive messages from a channel
+	WantsChannel(channel string) bool
+
+	// AddCapability marks a capability as acknowledged for the connection
+	AddCapability(capability string)
+	// RemoveCapability removes an acknowledged capability from the connection
+	RemoveCapability(capability string)
+	// HasCapability checks if a capability has been acknowledged for the connection
+	HasCapability(capability string) bool
+
+	// SetAuthenticated marks the connection as authenticated
+	SetAuthenticated(authenticated bool)
+	// IsAuthenticated checks if the connection has been authenticated
+	IsAuthenticated() bool
+	// SetRestricted marks the connection as limited to the channels it joins
+	SetRestricted(restricted bool)
+	// IsRestricted checks if the connection is limited to the channels it joins
+	IsRestricted() bool
+
+	// Queued returns the amount of messages waiting to be written
+	Queued() int
+	// Dropped returns the amount of messages dropped because the queue was full
+	Dropped() uint64
+}
+
+// state is shared by every transport, it keeps track of what a client has asked for
+type state struct {
+	id uint64
+
+	mu            sync.RWMutex
+	channels      map[string]struct{}
+	capabilities  map[string]struct{}
+	authenticated bool
+	restricted    bool
+}
+
+func newState(id uint64) state {
+	return state{
+		id:           id,
+		channels:     make(map[string]struct{}),
+		capabilities: make(map[string]struct{}),
+	}
+}
+
+func (s *state) ID() uint64 {
+	return s.id
+}
+
+func (s *state) JoinChannel(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels[channel] = struct{}{}
+}
+
+func (s *state) PartChannel(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.channels, channel)
+}
+
+func (s *state) IsJoined(channel string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.channels[channel]
+	return ok
+}
+
+func (s *state) Channels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	channels := make([]string, 0, len(s.channels))
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+
+	return channels
+}
+
+// Connections with the firehose capability receive every channel
+func (s *state) WantsChannel(channel string) bool {
+	return s.HasCapability(CapabilityFirehose) || s.IsJoined(channel)
+}
+
+func (s *state) AddCapability(capability string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.capabilities[capability] = struct{}{}
+}
+
+func (s *state) RemoveCapability(capability string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.capabilities, capability)
+}
+
+func (s *state) HasCapability(capability string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.capabilities[capability]
+	return ok
+}
+
+// Only authenticated connections receive broadcasts
+func (s *state) SetAuthenticated(authenticated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.authenticated = authenticated
+}
+
+func (s *state) IsAuthenticated() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.authenticated
+}
+
+// Restricted connections don't receive messages which belong to no channel, such as whispers
+func (s *state) SetRestricted(restricted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restricted = restricted
+}
+
+func (s *state) IsRestricted() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.restricted
+}
@@ -3,22 +3,32 @@ package tcp
 import (
 	"bufio"
 	"net"
+	"sync"
 )
 
 // Connection is a wrapper for a TCP connection
 type Connection struct {
+	state
+	*outbound
+
 	conn net.Conn
 	r    *bufio.Reader
 	w    *bufio.Writer
+	wmu  sync.Mutex
 }
 
 // NewConnection creates a new connection
-func NewConnection(conn net.Conn) *Connection {
-	return &Connection{
-		conn: conn,
-		r:    bufio.NewReader(conn),
-		w:    bufio.NewWriter(conn),
+func NewConnection(id uint64, conn net.Conn, opts Options) *Connection {
+	c := &Connection{
+		state: newState(id),
+		conn:  conn,
+		r:     bufio.NewReader(conn),
+		w:     bufio.NewWriter(conn),
 	}
+
+	c.outbound = newOutbound(opts, conn, c.writeString)
+
+	return c
 }
 
 // Read reads a message from the connection
@@ -31,16 +41,20 @@ func (c *Connection) ReadString() (string, error) {
 	return c.r.ReadString('\n') // FIXME: Should read until \r\n?
 }
 
-// Write writes a message to the connection
+// Write queues a message to be written to the connection
 func (c *Connection) Write(msg []byte) error {
-	_, err := c.w.Write(msg)
-	if err != nil {
-		return err
-	}
-	return c.w.Flush()
+	return c.enqueue(string(msg))
 }
 
+// WriteString queues a message to be written to the connection
 func (c *Connection) WriteString(msg string) error {
+	return c.enqueue(msg)
+}
+
+func (c *Connection) writeString(msg string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
 	_, err := c.w.WriteString(msg)
 	if err != nil {
 		return err
@@ -48,7 +62,14 @@ func (c *Connection) WriteString(msg string) error {
 	return c.w.Flush()
 }
 
-// Close closes the connection
+// Close writes any queued messages and closes the connection
 func (c *Connection) Close() error {
+	c.flush()
+
 	return c.conn.Close()
 }
+
+// RemoteAddr returns the address of the client
+func (c *Connection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
@@ -2,81 +2,275 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+var (
+	ErrServerClosed       = errors.New("server is closed")
+	ErrConnectionNotFound = errors.New("connection not found")
+	ErrTooManyConnections = errors.New("too many connections")
+)
+
+const (
+	tooManyConnectionsError = "ERROR :Closing Link: Too many connections\r\n"
+)
+
+// Line breaks in a kick reason would let it write arbitrary lines to the client
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
 // Server is a wrapper for a TCP server
+//
+// A server can listen on several addresses at once, for example plaintext, TLS and WebSocket,
+// connections from every listener share the same broadcasts.
 type Server struct {
-	listener    net.Listener
-	connections []*Connection
+	opts   Options
+	nextID atomic.Uint64
+
+	mu          sync.RWMutex
+	closed      bool
+	connections map[uint64]Conn
+}
+
+// ConnectionInfo describes a single connection
+type ConnectionInfo struct {
+	ID         uint64   `json:"id"`
+	RemoteAddr string   `json:"remote_addr"`
+	Channels   []string `json:"channels"`
+	Queued     int      `json:"queued"`
+	Dropped    uint64   `json:"dropped"`
 }
 
 // NewServer creates a new server
-func NewServer() *Server {
-	return &Server{}
+func NewServer(opts Options) *Server {
+	return &Server{
+		opts:        opts,
+		connections: make(map[uint64]Conn),
+	}
+}
+
+// Registers a connection, fails if the server is closed or full
+func (s *Server) addConnection(c Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	if s.opts.MaxConnections > 0 && len(s.connections) >= s.opts.MaxConnections {
+		return ErrTooManyConnections
+	}
+
+	s.connections[c.ID()] = c
+
+	return nil
 }
 
-func (s *Server) addConnection(c *Connection) {
-	s.connections = append(s.connections, c)
+func (s *Server) removeConnection(c Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.connections, c.ID())
 }
 
-func (s *Server) removeConnection(c *Connection) {
-	for i, conn := range s.connections {
-		if conn == c {
-			s.connections = append(s.connections[:i], s.connections[i+1:]...)
-			return
-		}
+// Returns a copy of every connection, so they can be used without holding the lock
+func (s *Server) snapshot() []Conn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conns := make([]Conn, 0, len(s.connections))
+	for _, conn := range s.connections {
+		conns = append(conns, conn)
 	}
+
+	return conns
 }
 
-// Start starts the server
-func (s *Server) Start(ctx context.Context, addr string, handler func(*Connection)) error {
-	var err error
-	s.listener, err = net.Listen("tcp", addr)
+// Start starts listening for plaintext connections
+//
+// This is a blocking operation
+func (s *Server) Start(ctx context.Context, addr string, handler func(Conn)) error {
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
+	return s.serve(ctx, listener, handler)
+}
+
+// StartTLS starts listening for TLS connections
+//
+// This is a blocking operation
+func (s *Server) StartTLS(ctx context.Context, addr string, config *tls.Config, handler func(Conn)) error {
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+
+	return s.serve(ctx, listener, handler)
+}
+
+func (s *Server) serve(ctx context.Context, listener net.Listener, handler func(Conn)) error {
 	go func() {
 		<-ctx.Done()
-		s.listener.Close()
+		listener.Close()
+
+		s.Shutdown()
 	}()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+
 			return err
 		}
 
-		connWrap := NewConnection(conn)
+		go s.handle(NewConnection(s.nextID.Add(1), conn, s.opts), handler)
+	}
+}
 
-		s.addConnection(connWrap)
+// Runs handler for a connection, closing it once handler returns
+func (s *Server) handle(c Conn, handler func(Conn)) {
+	if err := s.addConnection(c); err != nil {
+		if err == ErrTooManyConnections {
+			_ = c.WriteString(tooManyConnectionsError)
+		}
+
+		_ = c.Close()
+		return
+	}
+
+	defer s.removeConnection(c)
+
+	handler(c)
 
-		go func() {
-			handler(connWrap)
+	_ = c.Close()
+}
 
-			_ = connWrap.conn.Close()
+// Shutdown closes every connection and stops accepting new ones
+//
+// Listeners are closed when the context given to Start is cancelled, which also calls Shutdown
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
 
-			s.removeConnection(connWrap)
-		}()
+	for _, conn := range s.snapshot() {
+		_ = conn.Close()
 	}
 }
 
-// Broadcast sends a message to all connections
-func (s *Server) Broadcast(msg string) error {
-	for _, conn := range s.connections {
-		err := conn.WriteString(msg)
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.closed
+}
 
-		switch err {
-		case nil:
+// Broadcast sends a message to every authenticated connection interested in the channel
+//
+// An empty channel sends the message to all connections
+func (s *Server) Broadcast(channel, msg string) {
+	s.BroadcastWith(channel, func(Conn) string {
+		return msg
+	})
+}
+
+// BroadcastWith works like Broadcast, but lets format decide what each connection receives
+//
+// Connections are skipped if format returns an empty string
+func (s *Server) BroadcastWith(channel string, format func(Conn) string) {
+	if s.isClosed() {
+		return
+	}
+
+	for _, conn := range s.snapshot() {
+		if !conn.IsAuthenticated() {
 			continue
-		case net.ErrClosed:
-			s.removeConnection(conn)
+		}
+
+		// Messages without a channel, like whispers, belong to the bot as a whole
+		if channel == "" && conn.IsRestricted() {
+			continue
+		}
+
+		if channel != "" && !conn.WantsChannel(channel) {
 			continue
-		default:
-			return err
 		}
+
+		msg := format(conn)
+		if msg == "" {
+			continue
+		}
+
+		// Messages are queued, a full queue is handled by the connection itself
+		_ = conn.WriteString(msg)
 	}
+}
 
-	return nil
+// Get returns a connection by its ID
+func (s *Server) Get(id uint64) (Conn, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conn, ok := s.connections[id]
+	return conn, ok
+}
+
+// Kick disconnects a connection, telling it why with an ERROR line
+//
+// Line breaks in reason are replaced with spaces, so it can't be used to send anything other than the ERROR
+func (s *Server) Kick(id uint64, reason string) error {
+	conn, ok := s.Get(id)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+
+	_ = conn.WriteString(fmt.Sprintf("ERROR :Closing Link: %s\r\n", lineBreaks.Replace(reason)))
+
+	return conn.Close()
+}
+
+// Connections returns information about every connection, ordered by ID
+func (s *Server) Connections() []ConnectionInfo {
+	conns := s.snapshot()
+
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, ConnectionInfo{
+			ID:         conn.ID(),
+			RemoteAddr: conn.RemoteAddr().String(),
+			Channels:   conn.Channels(),
+			Queued:     conn.Queued(),
+			Dropped:    conn.Dropped(),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
 }
@@ -0,0 +1,313 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts a server on a random port, handler echoes every line and joins the channel it receives
+func startTestServer(t *testing.T, opts Options) (*Server, string, context.CancelFunc) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServer(opts)
+
+	go func() {
+		_ = s.serve(ctx, listener, func(c Conn) {
+			c.SetAuthenticated(true)
+
+			for {
+				line, err := c.ReadString()
+				if err != nil {
+					return
+				}
+
+				c.JoinChannel(strings.TrimSpace(line))
+				_ = c.WriteString("JOINED\r\n")
+			}
+		})
+	}()
+
+	t.Cleanup(cancel)
+
+	return s, listener.Addr().String(), cancel
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	s, addr, _ := startTestServer(t, Options{})
+
+	const clients = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			fmt.Fprintf(conn, "channel%d\r\n", i%5)
+
+			// Broadcasts can arrive before the reply
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					t.Errorf("expected JOINED: %v", err)
+					return
+				}
+
+				if line == "JOINED\r\n" {
+					break
+				}
+			}
+
+			// Reads broadcasts while other clients come and go
+			_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			for {
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+
+	stop := make(chan struct{})
+	var broadcasters sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		broadcasters.Add(1)
+
+		go func(i int) {
+			defer broadcasters.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				s.Broadcast(fmt.Sprintf("channel%d", i), "PRIVMSG\r\n")
+				_ = s.Connections()
+
+				// Keeps the queues from overflowing, which would drop the reply
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(stop)
+	broadcasters.Wait()
+
+	waitFor(t, "every connection to be removed", func() bool {
+		return len(s.Connections()) == 0
+	})
+}
+
+func TestMaxConnections(t *testing.T) {
+	s, addr, _ := startTestServer(t, Options{MaxConnections: 1})
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	waitFor(t, "the first connection", func() bool {
+		return len(s.Connections()) == 1
+	})
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != tooManyConnectionsError {
+		t.Errorf("expected %q, got %q", tooManyConnectionsError, line)
+	}
+
+	if n := len(s.Connections()); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestKick(t *testing.T) {
+	s, addr, _ := startTestServer(t, Options{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitFor(t, "the connection", func() bool {
+		return len(s.Connections()) == 1
+	})
+
+	id := s.Connections()[0].ID
+
+	if err := s.Kick(id+1, "Nope"); err != ErrConnectionNotFound {
+		t.Errorf("expected ErrConnectionNotFound, got %v", err)
+	}
+
+	// The reason can't be used to write another line
+	if err := s.Kick(id, "Kicked\r\n:tmi.twitch.tv PRIVMSG #forsen :hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "ERROR :Closing Link: Kicked  :tmi.twitch.tv PRIVMSG #forsen :hi\r\n" {
+		t.Errorf("unexpected line %q", line)
+	}
+
+	if extra, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %q %v", extra, err)
+	}
+
+	waitFor(t, "the connection to be removed", func() bool {
+		_, ok := s.Get(id)
+		return !ok
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	s, addr, cancel := startTestServer(t, Options{})
+
+	conns := make([]net.Conn, 10)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conns[i] = conn
+	}
+
+	waitFor(t, "every connection", func() bool {
+		return len(s.Connections()) == len(conns)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				s.Broadcast("", "PING\r\n")
+			}
+		}()
+	}
+
+	cancel()
+	s.Shutdown()
+	wg.Wait()
+
+	waitFor(t, "every connection to be removed", func() bool {
+		return len(s.Connections()) == 0
+	})
+
+	if err := s.Start(context.Background(), "127.0.0.1:0", func(Conn) {}); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestBroadcastSkipsRestrictedForGlobalMessages(t *testing.T) {
+	s := NewServer(Options{})
+
+	type client struct {
+		conn   *Connection
+		reader *bufio.Reader
+	}
+
+	clients := make([]client, 2)
+	for i := range clients {
+		server, conn := net.Pipe()
+		t.Cleanup(func() { conn.Close() })
+
+		c := NewConnection(uint64(i+1), server, Options{})
+		t.Cleanup(func() { c.Close() })
+
+		c.SetAuthenticated(true)
+		c.JoinChannel("forsen")
+
+		if err := s.addConnection(c); err != nil {
+			t.Fatal(err)
+		}
+
+		clients[i] = client{conn: c, reader: bufio.NewReader(conn)}
+	}
+
+	clients[1].conn.SetRestricted(true)
+
+	s.Broadcast("", "WHISPER\r\n")
+	s.Broadcast("forsen", "PRIVMSG\r\n")
+
+	expected := [][]string{
+		{"WHISPER\r\n", "PRIVMSG\r\n"},
+		// The restricted client only gets the channel it joined
+		{"PRIVMSG\r\n"},
+	}
+
+	for i, lines := range expected {
+		for _, want := range lines {
+			line, err := clients[i].reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if line != want {
+				t.Errorf("client %d: expected %q, got %q", i, want, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a client can't keep up with its messages
+type OverflowPolicy int
+
+const (
+	// Drop the oldest queued message to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// Drop the new message
+	DropNewest
+	// Send an ERROR and disconnect the client
+	Disconnect
+)
+
+const (
+	// Default amount of messages queued for a single connection
+	DefaultQueueSize = 1024
+
+	slowConsumerError = "ERROR :Closing Link: Slow consumer\r\n"
+	// How long a stalled connection gets to receive the ERROR line
+	slowConsumerTimeout = 5 * time.Second
+	// How long a closing connection gets to receive what is still queued
+	flushTimeout = time.Second
+)
+
+var (
+	ErrQueueFull = errors.New("outbound queue is full")
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseOverflowPolicy parses the name of a policy, an empty string is DropOldest
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "", "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	case "disconnect":
+		return Disconnect, nil
+	default:
+		return DropOldest, fmt.Errorf("unknown overflow policy %s", name)
+	}
+}
+
+// Options configures every connection accepted by a Server
+type Options struct {
+	// Amount of messages queued for a single connection before Overflow applies
+	QueueSize int
+	Overflow  OverflowPolicy
+	// Maximum amount of connections across every listener, 0 is unlimited
+	MaxConnections int
+}
+
+// outbound queues messages for a connection and writes them from its own goroutine,
+// so a slow client never blocks the one sending to it
+type outbound struct {
+	queue   chan string
+	policy  OverflowPolicy
+	dropped atomic.Uint64
+
+	// Writes directly to the transport
+	write func(msg string) error
+	// Closes the transport
+	close func() error
+	// Sets a write deadline on the transport
+	deadline func(t time.Time) error
+
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	// Closed once the writer has stopped
+	stopped chan struct{}
+	// Set when the queue should be thrown away instead of written on shutdown
+	discard atomic.Bool
+}
+
+func newOutbound(opts Options, conn net.Conn, write func(msg string) error) *outbound {
+	size := opts.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+
+	o := &outbound{
+		queue:    make(chan string, size),
+		policy:   opts.Overflow,
+		write:    write,
+		close:    conn.Close,
+		deadline: conn.SetWriteDeadline,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go o.run()
+
+	return o
+}
+
+// Queues a message, applying the overflow policy if the queue is full
+func (o *outbound) enqueue(msg string) error {
+	// Serializes enqueue so dropping the oldest message can't race with another enqueue
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	select {
+	case <-o.done:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case o.queue <- msg:
+		return nil
+	default:
+	}
+
+	switch o.policy {
+	case DropOldest:
+		for {
+			select {
+			case o.queue <- msg:
+				return nil
+			default:
+			}
+
+			select {
+			case <-o.queue:
+				o.dropped.Add(1)
+			default:
+			}
+		}
+	case Disconnect:
+		o.dropped.Add(1)
+
+		go o.disconnect()
+
+		return ErrQueueFull
+	default:
+		o.dropped.Add(1)
+
+		return ErrQueueFull
+	}
+}
+
+// Writes queued messages until the connection is closed
+func (o *outbound) run() {
+	defer close(o.stopped)
+
+	for {
+		select {
+		case <-o.done:
+			o.drain()
+			return
+		case msg := <-o.queue:
+			if err := o.write(msg); err != nil {
+				o.shutdown()
+				_ = o.close()
+				return
+			}
+		}
+	}
+}
+
+// Writes whatever is left in the queue, unless it should be discarded
+func (o *outbound) drain() {
+	if o.discard.Load() {
+		return
+	}
+
+	for {
+		select {
+		case msg := <-o.queue:
+			if err := o.write(msg); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Stops the writer after it has written what is still queued
+//
+// A client which stopped reading gets flushTimeout to receive it
+func (o *outbound) flush() {
+	_ = o.deadline(time.Now().Add(flushTimeout))
+
+	o.shutdown()
+
+	<-o.stopped
+}
+
+// Tells a stalled client why it's being disconnected, if it is still reading at all
+func (o *outbound) disconnect() {
+	o.discard.Store(true)
+
+	// Unblocks the writer if it's stuck writing to the client
+	_ = o.deadline(time.Now().Add(slowConsumerTimeout))
+
+	if !o.shutdown() {
+		return
+	}
+
+	<-o.stopped
+
+	_ = o.deadline(time.Now().Add(slowConsumerTimeout))
+	_ = o.write(slowConsumerError)
+	_ = o.close()
+}
+
+// Stops the writer, returns false if it already was
+func (o *outbound) shutdown() bool {
+	stopped := false
+
+	o.closeOnce.Do(func() {
+		close(o.done)
+		stopped = true
+	})
+
+	return stopped
+}
+
+// Dropped returns the amount of messages dropped because the queue was full
+func (o *outbound) Dropped() uint64 {
+	return o.dropped.Load()
+}
+
+// Queued returns the amount of messages waiting to be written
+func (o *outbound) Queued() int {
+	return len(o.queue)
+}
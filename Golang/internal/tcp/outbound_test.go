@@ -0,0 +1,98 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverflowDropNewest(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := NewConnection(1, server, Options{QueueSize: 2, Overflow: DropNewest})
+	defer c.Close()
+
+	// Nobody is reading from client, so the writer stalls on the first message
+	for i := 0; i < 10; i++ {
+		c.WriteString(fmt.Sprintf("%d\r\n", i))
+	}
+
+	if c.Dropped() < 7 {
+		t.Errorf("Expected at least 7 dropped messages, got %d", c.Dropped())
+	}
+
+	if c.Queued() > 2 {
+		t.Errorf("Expected at most 2 queued messages, got %d", c.Queued())
+	}
+
+	if err := c.WriteString("10\r\n"); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := NewConnection(1, server, Options{QueueSize: 2, Overflow: DropOldest})
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := c.WriteString(fmt.Sprintf("%d\r\n", i)); err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+	}
+
+	if c.Dropped() < 7 {
+		t.Errorf("Expected at least 7 dropped messages, got %d", c.Dropped())
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+
+	// The newest message always survives
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Did not receive the newest message: %s", err)
+		}
+
+		if strings.TrimSpace(line) == "9" {
+			break
+		}
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := NewConnection(1, server, Options{QueueSize: 1, Overflow: Disconnect})
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		c.WriteString(fmt.Sprintf("%d\r\n", i))
+	}
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(client)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Connection closed without an ERROR: %s", err)
+		}
+
+		if strings.HasPrefix(line, "ERROR") {
+			break
+		}
+	}
+
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
@@ -0,0 +1,168 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	The WebSocket server transport,
+	carrying IRC lines in text frames the same way irc-ws.chat.twitch.tv does.
+*/
+
+// Largest message a client is allowed to send, IRC lines are far smaller
+const websocketMaxMessageSize = 64 * 1024
+
+// WebSocketConnection is a client connected using WebSocket
+type WebSocketConnection struct {
+	state
+	*outbound
+
+	ws *websocket.Conn
+
+	// Lines received in a message that have not been read yet
+	pending []string
+}
+
+func newWebSocketConnection(id uint64, ws *websocket.Conn, opts Options) *WebSocketConnection {
+	ws.SetReadLimit(websocketMaxMessageSize)
+
+	c := &WebSocketConnection{
+		state:   newState(id),
+		ws:      ws,
+		pending: make([]string, 0),
+	}
+
+	// Only the outbound goroutine writes data messages, as the websocket package requires
+	c.outbound = newOutbound(opts, ws.UnderlyingConn(), func(msg string) error {
+		return ws.WriteMessage(websocket.TextMessage, []byte(msg))
+	})
+
+	return c
+}
+
+// ReadString reads a single IRC line
+//
+// A text message can contain several lines, which are returned one at a time
+func (c *WebSocketConnection) ReadString() (string, error) {
+	for len(c.pending) == 0 {
+		_, payload, err := c.ws.ReadMessage()
+		if err != nil {
+			// The client closed the connection the way it should
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				return "", io.EOF
+			}
+
+			return "", err
+		}
+
+		for _, line := range strings.Split(string(payload), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if line == "" {
+				continue
+			}
+
+			c.pending = append(c.pending, line)
+		}
+	}
+
+	line := c.pending[0]
+	c.pending = c.pending[1:]
+
+	return line, nil
+}
+
+// WriteString queues the message to be sent as a single text frame
+func (c *WebSocketConnection) WriteString(msg string) error {
+	return c.enqueue(msg)
+}
+
+// Close writes any queued messages, sends a close frame and closes the connection
+func (c *WebSocketConnection) Close() error {
+	c.flush()
+
+	// Don't wait on a client which stopped reading
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(flushTimeout))
+
+	return c.ws.Close()
+}
+
+// RemoteAddr returns the address of the client
+func (c *WebSocketConnection) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// StartWebSocket starts listening for WebSocket connections, using TLS if config is not nil
+//
+// This is a blocking operation
+func (s *Server) StartWebSocket(ctx context.Context, addr string, config *tls.Config, handler func(Conn)) error {
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+
+	var listener net.Listener
+	var err error
+
+	if config != nil {
+		listener, err = tls.Listen("tcp", addr, config)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.serveWebSocket(ctx, listener, handler)
+}
+
+func (s *Server) serveWebSocket(ctx context.Context, listener net.Listener, handler func(Conn)) error {
+	server := &http.Server{
+		Handler:           s.websocketHandler(handler),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+
+		s.Shutdown()
+	}()
+
+	err := server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Upgrades a HTTP request to a WebSocket connection and hands it over to handler
+func (s *Server) websocketHandler(handler func(Conn)) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"irc"},
+		// Clients are bots rather than browsers, they authenticate with PASS like any other client
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Responds with 400 itself if the request is not a WebSocket upgrade
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		s.handle(newWebSocketConnection(s.nextID.Add(1), ws, s.opts), handler)
+	}
+}
@@ -0,0 +1,390 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Frame opcodes from RFC 6455, frames are written by hand so malformed ones can be sent
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+func TestWebSocketConnection(t *testing.T) {
+	lines := make(chan string, 2)
+
+	conn, r := dialWebSocket(t, func(c Conn) {
+		for i := 0; i < 2; i++ {
+			line, err := c.ReadString()
+			if err != nil {
+				return
+			}
+
+			lines <- line
+		}
+
+		c.WriteString(":tmi.twitch.tv PONG tmi.twitch.tv :hi\r\n")
+
+		// Wait for the client to close the connection
+		_, _ = c.ReadString()
+	})
+
+	// Two lines in one message, split across a continuation frame
+	writeFrame(conn, true, false, opText, []byte("PASS oauth:abc\r\nNICK me"))
+	writeFrame(conn, true, true, opContinuation, []byte("lon\r\n"))
+
+	for _, expected := range []string{"PASS oauth:abc", "NICK melon"} {
+		if line := receive(t, lines); line != expected {
+			t.Errorf("Expected %q, got %q", expected, line)
+		}
+	}
+
+	opcode, payload := readFrame(t, r)
+	if opcode != opText {
+		t.Errorf("Expected a text frame, got %x", opcode)
+	}
+
+	if string(payload) != ":tmi.twitch.tv PONG tmi.twitch.tv :hi\r\n" {
+		t.Errorf("Unexpected payload %q", payload)
+	}
+
+	writeFrame(conn, true, true, opClose, binary.BigEndian.AppendUint16(nil, 1000))
+}
+
+func TestWebSocketFragmentedFrames(t *testing.T) {
+	lines := make(chan string, 1)
+
+	conn, r := dialWebSocket(t, func(c Conn) {
+		line, err := c.ReadString()
+		if err != nil {
+			return
+		}
+
+		lines <- line
+
+		_, _ = c.ReadString()
+	})
+
+	// A ping can arrive between the fragments of a message
+	writeFrame(conn, true, false, opText, []byte("PRIVMSG #forsen "))
+	writeFrame(conn, true, false, opContinuation, []byte(":hello"))
+	writeFrame(conn, true, true, opPing, []byte("ping"))
+	writeFrame(conn, true, true, opContinuation, []byte(" world\r\n"))
+
+	opcode, payload := readFrame(t, r)
+	if opcode != opPong || string(payload) != "ping" {
+		t.Errorf("Expected a pong echoing the ping, got %x %q", opcode, payload)
+	}
+
+	if line := receive(t, lines); line != "PRIVMSG #forsen :hello world" {
+		t.Errorf("Unexpected line %q", line)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		write     func(net.Conn)
+		closeCode uint16
+	}{
+		{
+			name: "oversized payload",
+			write: func(conn net.Conn) {
+				writeFrame(conn, true, true, opText, make([]byte, websocketMaxMessageSize+1))
+			},
+			closeCode: 1009,
+		},
+		{
+			name: "oversized across fragments",
+			write: func(conn net.Conn) {
+				writeFrame(conn, true, false, opText, make([]byte, websocketMaxMessageSize/2+1))
+				writeFrame(conn, true, true, opContinuation, make([]byte, websocketMaxMessageSize/2+1))
+			},
+			closeCode: 1009,
+		},
+		{
+			name: "unmasked frame",
+			write: func(conn net.Conn) {
+				writeFrame(conn, false, true, opText, []byte("PASS oauth:abc\r\n"))
+			},
+			closeCode: 1002,
+		},
+		{
+			name: "continuation without a message",
+			write: func(conn net.Conn) {
+				writeFrame(conn, true, true, opContinuation, []byte("PASS oauth:abc\r\n"))
+			},
+			closeCode: 1002,
+		},
+	}
+
+	for _, test := range tests {
+		errs := make(chan error, 1)
+
+		conn, r := dialWebSocket(t, func(c Conn) {
+			_, err := c.ReadString()
+			errs <- err
+		})
+
+		// Large frames may not be read completely before the server gives up
+		go test.write(conn)
+
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for an error", test.name)
+		}
+
+		opcode, payload := readFrame(t, r)
+		if opcode != opClose || len(payload) < 2 {
+			t.Errorf("%s: expected a close frame, got %x %q", test.name, opcode, payload)
+			continue
+		}
+
+		if code := binary.BigEndian.Uint16(payload); code != test.closeCode {
+			t.Errorf("%s: expected close code %d, got %d", test.name, test.closeCode, code)
+		}
+	}
+}
+
+func TestWebSocketClientClose(t *testing.T) {
+	errs := make(chan error, 1)
+
+	conn, r := dialWebSocket(t, func(c Conn) {
+		_, err := c.ReadString()
+		errs <- err
+	})
+
+	writeFrame(conn, true, true, opClose, binary.BigEndian.AppendUint16(nil, 1000))
+
+	// The close frame is answered before the connection is closed
+	opcode, payload := readFrame(t, r)
+	if opcode != opClose {
+		t.Errorf("Expected a close frame, got %x", opcode)
+	}
+
+	if len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("Expected close code 1000, got %q", payload)
+	}
+
+	select {
+	case err := <-errs:
+		if err != io.EOF {
+			t.Errorf("Expected io.EOF, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the handler")
+	}
+}
+
+func TestWebSocketServerClose(t *testing.T) {
+	conn, r := dialWebSocket(t, func(c Conn) {
+		c.WriteString(":tmi.twitch.tv NOTICE * :Login authentication failed\r\n")
+	})
+
+	// Queued messages are written before the close frame when the handler returns
+	opcode, payload := readFrame(t, r)
+	if opcode != opText || string(payload) != ":tmi.twitch.tv NOTICE * :Login authentication failed\r\n" {
+		t.Errorf("Expected the queued message, got %x %q", opcode, payload)
+	}
+
+	opcode, payload = readFrame(t, r)
+	if opcode != opClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("Expected a normal close frame, got %x %q", opcode, payload)
+	}
+
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+
+	conn.Close()
+}
+
+func TestWebSocketRejectsPlainHTTP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(Options{})
+
+	go s.serveWebSocket(ctx, listener, func(c Conn) {
+		t.Error("Handler should not be called")
+	})
+
+	res, err := http.Get("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", res.StatusCode)
+	}
+}
+
+// Starts a WebSocket server running handler and completes the handshake with it
+func dialWebSocket(t *testing.T, handler func(Conn)) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(Options{})
+
+	go s.serveWebSocket(ctx, listener, handler)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET / HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Protocol: irc\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", res.StatusCode)
+	}
+
+	// Example from RFC 6455
+	if res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("Unexpected Sec-WebSocket-Accept")
+	}
+
+	if res.Header.Get("Sec-WebSocket-Protocol") != "irc" {
+		t.Error("Expected the irc subprotocol to be selected")
+	}
+
+	return conn, r
+}
+
+// Writes a client frame, clients have to mask every frame so masked is only false to test that
+func writeFrame(w io.Writer, masked, fin bool, opcode byte, payload []byte) {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+
+	frame := []byte{first}
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if !masked {
+		w.Write(append(frame, payload...))
+		return
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	w.Write(frame)
+}
+
+// Reads a single unfragmented server frame
+func readFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if header[0]&0x80 == 0 {
+		t.Fatalf("Expected a final frame, got %x", header[0])
+	}
+
+	if header[1]&0x80 != 0 {
+		t.Fatal("Server frames must not be masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return header[0] & 0x0F, payload
+}
+
+func receive(t *testing.T, lines chan string) string {
+	t.Helper()
+
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for line")
+	}
+
+	return ""
+}
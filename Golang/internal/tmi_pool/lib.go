@@ -0,0 +1,597 @@
+package tmipool
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// Default amount of channels joined on a single upstream connection
+	DefaultChannelsPerConnection = 50
+
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 1 * time.Minute
+	// A wrong token won't fix itself quickly, so login failures are retried far less often
+	maxLoginFailureDelay = 30 * time.Minute
+
+	// A healthy connection receives something, at least a PONG, every IdlePingInterval + PongTimeout
+	deadAfter     = 1 * time.Minute
+	watchInterval = 10 * time.Second
+)
+
+type Options struct {
+	Username string
+	OAuth    string
+	// Maximum amount of channels joined on a single upstream connection
+	ChannelsPerConnection int
+	// Use the rate limits of a verified bot when joining channels
+	Verified bool
+}
+
+// connection is a single upstream connection owned by the pool
+type connection struct {
+	id       int
+	client   *twitch.Client
+	channels map[string]struct{}
+	// Set when the pool closed the connection on purpose
+	closed bool
+	// Unix nanoseconds of when the connection last connected or received anything
+	lastSeen atomic.Int64
+}
+
+func (c *connection) seen(now time.Time) {
+	c.lastSeen.Store(now.UnixNano())
+}
+
+// Checks if the connection hasn't connected or received anything for too long
+func (c *connection) isDead(now time.Time) bool {
+	return now.Sub(time.Unix(0, c.lastSeen.Load())) > deadAfter
+}
+
+// Pool spreads joined channels across several upstream TMI connections
+//
+// Incoming messages from every connection are merged into a single set of callbacks,
+// which are called from the goroutine of the connection that received the message.
+type Pool struct {
+	opts Options
+	ctx  context.Context
+
+	mu            sync.Mutex
+	started       bool
+	nextID        int
+	connections   map[int]*connection
+	assigned      map[string]*connection
+	failures      int
+	loginFailures int
+
+	onConnect          func()
+	onPrivateMessage   func(message twitch.PrivateMessage)
+	onNoticeMessage    func(message twitch.NoticeMessage)
+	onSelfJoinMessage  func(message twitch.UserJoinMessage)
+	onSelfPartMessage  func(message twitch.UserPartMessage)
+	onUserJoinMessage  func(message twitch.UserJoinMessage)
+	onUserPartMessage  func(message twitch.UserPartMessage)
+	onUserStateMessage func(message twitch.UserStateMessage)
+	onRawMessage       func(raw string)
+}
+
+// ConnectionInfo describes the state of a single upstream connection
+type ConnectionInfo struct {
+	ID       int `json:"id"`
+	Channels int `json:"channels"`
+}
+
+func New(opts Options) *Pool {
+	if opts.ChannelsPerConnection <= 0 {
+		opts.ChannelsPerConnection = DefaultChannelsPerConnection
+	}
+
+	return &Pool{
+		opts:        opts,
+		ctx:         context.Background(),
+		connections: make(map[int]*connection),
+		assigned:    make(map[string]*connection),
+	}
+}
+
+// OnConnect is called every time one of the upstream connections connects
+func (p *Pool) OnConnect(callback func()) {
+	p.onConnect = callback
+}
+
+func (p *Pool) OnPrivateMessage(callback func(message twitch.PrivateMessage)) {
+	p.onPrivateMessage = callback
+}
+
+func (p *Pool) OnNoticeMessage(callback func(message twitch.NoticeMessage)) {
+	p.onNoticeMessage = callback
+}
+
+func (p *Pool) OnSelfJoinMessage(callback func(message twitch.UserJoinMessage)) {
+	p.onSelfJoinMessage = callback
+}
+
+func (p *Pool) OnSelfPartMessage(callback func(message twitch.UserPartMessage)) {
+	p.onSelfPartMessage = callback
+}
+
+func (p *Pool) OnUserJoinMessage(callback func(message twitch.UserJoinMessage)) {
+	p.onUserJoinMessage = callback
+}
+
+func (p *Pool) OnUserPartMessage(callback func(message twitch.UserPartMessage)) {
+	p.onUserPartMessage = callback
+}
+
+func (p *Pool) OnUserStateMessage(callback func(message twitch.UserStateMessage)) {
+	p.onUserStateMessage = callback
+}
+
+// OnRawMessage is called with the raw line of every message received upstream
+//
+// PING and PONG are handled by the connections themselves and are not included
+func (p *Pool) OnRawMessage(callback func(raw string)) {
+	p.onRawMessage = callback
+}
+
+// Connect starts the first upstream connection, more are created as channels are joined
+//
+// This is a blocking operation, every connection is closed when the context is cancelled
+func (p *Pool) Connect(ctx context.Context) error {
+	p.mu.Lock()
+	p.ctx = ctx
+	p.started = true
+	if len(p.connections) == 0 {
+		p.spawn()
+	} else {
+		for _, conn := range p.connections {
+			conn.seen(time.Now())
+			go p.run(conn)
+		}
+	}
+	p.mu.Unlock()
+
+	p.watch(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.connections {
+		conn.closed = true
+		_ = conn.client.Disconnect()
+	}
+
+	return nil
+}
+
+// Join joins channels, spreading them over the connections with the fewest channels
+func (p *Pool) Join(channels ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, channel := range channels {
+		p.join(channel)
+	}
+}
+
+// Depart leaves a channel on the connection it was joined on
+func (p *Pool) Depart(channel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn, ok := p.assigned[channel]
+	if !ok {
+		return
+	}
+
+	conn.client.Depart(channel)
+
+	delete(conn.channels, channel)
+	delete(p.assigned, channel)
+
+	// Always keep one connection around for sending messages to channels we are not in
+	if len(conn.channels) == 0 && len(p.connections) > 1 {
+		zap.S().Infof("Closing idle upstream connection %d", conn.id)
+
+		conn.closed = true
+		delete(p.connections, conn.id)
+		_ = conn.client.Disconnect()
+	}
+}
+
+// Say sends a message using the connection the channel is joined on
+func (p *Pool) Say(channel, text string) {
+	if client := p.clientFor(channel); client != nil {
+		client.Say(channel, text)
+	}
+}
+
+// Reply replies to a message using the connection the channel is joined on
+func (p *Pool) Reply(channel, parentMsgID, text string) {
+	if client := p.clientFor(channel); client != nil {
+		client.Reply(channel, parentMsgID, text)
+	}
+}
+
+// Connections returns information about every upstream connection
+func (p *Pool) Connections() []ConnectionInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	infos := make([]ConnectionInfo, 0, len(p.connections))
+	for _, conn := range p.connections {
+		infos = append(infos, ConnectionInfo{
+			ID:       conn.id,
+			Channels: len(conn.channels),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+func (p *Pool) clientFor(channel string) *twitch.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conn, ok := p.assigned[channel]; ok {
+		return conn.client
+	}
+
+	// Not joined, any connection will do
+	for _, conn := range p.connections {
+		return conn.client
+	}
+
+	return nil
+}
+
+// Must be called with the lock held
+func (p *Pool) join(channel string) {
+	if _, ok := p.assigned[channel]; ok {
+		return
+	}
+
+	var target *connection
+	for _, conn := range p.connections {
+		if len(conn.channels) >= p.opts.ChannelsPerConnection {
+			continue
+		}
+
+		if target == nil || len(conn.channels) < len(target.channels) {
+			target = conn
+		}
+	}
+
+	if target == nil {
+		target = p.spawn()
+	}
+
+	target.channels[channel] = struct{}{}
+	p.assigned[channel] = target
+
+	target.client.Join(channel)
+}
+
+// Creates a new connection, must be called with the lock held
+func (p *Pool) spawn() *connection {
+	p.nextID++
+
+	conn := &connection{
+		id:       p.nextID,
+		client:   twitch.NewClient(p.opts.Username, p.opts.OAuth),
+		channels: make(map[string]struct{}),
+	}
+	conn.seen(time.Now())
+
+	if p.opts.Verified {
+		conn.client.SetJoinRateLimiter(twitch.CreateVerifiedRateLimiter())
+	}
+
+	p.attach(conn)
+	p.connections[conn.id] = conn
+
+	// Connections created before Connect are started by Connect
+	if p.started {
+		go p.run(conn)
+	}
+
+	return conn
+}
+
+func (p *Pool) run(conn *connection) {
+	zap.S().Infof("Starting upstream connection %d", conn.id)
+
+	err := conn.client.Connect()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conn.closed || p.ctx.Err() != nil {
+		return
+	}
+
+	zap.S().Errorf("Upstream connection %d died: %v", conn.id, err)
+
+	p.remove(conn, err)
+}
+
+// Checks the connections until ctx is cancelled, moving the channels of dead ones
+//
+// Connect only returns once the client gives up, a connection which keeps failing to reconnect,
+// or hangs without being noticed, is only caught by looking at when it last received anything
+func (p *Pool) watch(ctx context.Context) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.reap(now)
+		}
+	}
+}
+
+// Removes every connection which is dead at now
+func (p *Pool) reap(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.connections {
+		if !conn.isDead(now) {
+			continue
+		}
+
+		zap.S().Errorf("Upstream connection %d has not received anything for %s", conn.id, deadAfter)
+
+		// Closed first, so run doesn't move the channels a second time once Connect returns
+		conn.closed = true
+		_ = conn.client.Disconnect()
+
+		// Disconnect does nothing while the client is between connections,
+		// so it is made to forget its channels in case it does come back
+		for channel := range conn.channels {
+			conn.client.Depart(channel)
+		}
+
+		p.remove(conn, nil)
+	}
+}
+
+// Removes a connection and moves its channels after a delay, must be called with the lock held
+func (p *Pool) remove(conn *connection, err error) {
+	delete(p.connections, conn.id)
+
+	channels := make([]string, 0, len(conn.channels))
+	for channel := range conn.channels {
+		channels = append(channels, channel)
+		delete(p.assigned, channel)
+	}
+
+	delay := p.delayFor(err)
+
+	zap.S().Infof("Moving %d channels from connection %d in %s", len(channels), conn.id, delay)
+
+	go p.rebalance(channels, delay)
+}
+
+// How long to wait before moving the channels of a connection which died with err
+//
+// Must be called with the lock held
+func (p *Pool) delayFor(err error) time.Duration {
+	if errors.Is(err, twitch.ErrLoginAuthenticationFailed) {
+		p.loginFailures++
+		return backoff(minReconnectDelay*30, maxLoginFailureDelay, p.loginFailures)
+	}
+
+	p.failures++
+	return backoff(minReconnectDelay, maxReconnectDelay, p.failures)
+}
+
+// Doubles min for every failure after the first, up to max
+func backoff(min, max time.Duration, failures int) time.Duration {
+	delay := min << (failures - 1)
+	if delay > max || delay <= 0 {
+		return max
+	}
+
+	return delay
+}
+
+// Joins the channels of a dead connection on the remaining ones after a delay
+func (p *Pool) rebalance(channels []string, delay time.Duration) {
+	select {
+	case <-p.ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.connections) == 0 {
+		p.spawn()
+	}
+
+	for _, channel := range channels {
+		p.join(channel)
+	}
+}
+
+// Registers the pool's callbacks on a connection
+func (p *Pool) attach(conn *connection) {
+	c := conn.client
+
+	c.OnConnect(func() {
+		conn.seen(time.Now())
+
+		p.mu.Lock()
+		p.failures = 0
+		p.loginFailures = 0
+		p.mu.Unlock()
+
+		zap.S().Infof("Upstream connection %d connected", conn.id)
+
+		if p.onConnect != nil {
+			p.onConnect()
+		}
+	})
+
+	c.OnPrivateMessage(func(message twitch.PrivateMessage) {
+		if p.onPrivateMessage != nil {
+			p.onPrivateMessage(message)
+		}
+
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnNoticeMessage(func(message twitch.NoticeMessage) {
+		if p.onNoticeMessage != nil {
+			p.onNoticeMessage(message)
+		}
+
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnSelfJoinMessage(func(message twitch.UserJoinMessage) {
+		if p.onSelfJoinMessage != nil {
+			p.onSelfJoinMessage(message)
+		}
+
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnSelfPartMessage(func(message twitch.UserPartMessage) {
+		if p.onSelfPartMessage != nil {
+			p.onSelfPartMessage(message)
+		}
+
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnUserJoinMessage(func(message twitch.UserJoinMessage) {
+		if p.onUserJoinMessage != nil {
+			p.onUserJoinMessage(message)
+		}
+
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnUserPartMessage(func(message twitch.UserPartMessage) {
+		if p.onUserPartMessage != nil {
+			p.onUserPartMessage(message)
+		}
+
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnUserStateMessage(func(message twitch.UserStateMessage) {
+		if p.onUserStateMessage != nil {
+			p.onUserStateMessage(message)
+		}
+
+		p.raw(conn, message.Raw)
+	})
+
+	/*
+		The remaining message types are only forwarded as they are
+	*/
+
+	c.OnWhisperMessage(func(message twitch.WhisperMessage) {
+		p.global(conn, message.Raw)
+	})
+
+	c.OnClearChatMessage(func(message twitch.ClearChatMessage) {
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnClearMessage(func(message twitch.ClearMessage) {
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnRoomStateMessage(func(message twitch.RoomStateMessage) {
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnUserNoticeMessage(func(message twitch.UserNoticeMessage) {
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnGlobalUserStateMessage(func(message twitch.GlobalUserStateMessage) {
+		p.global(conn, message.Raw)
+	})
+
+	// PING and PONG aren't forwarded, but show the connection is alive
+	c.OnPingMessage(func(message twitch.PingMessage) {
+		conn.seen(time.Now())
+	})
+
+	c.OnPongMessage(func(message twitch.PongMessage) {
+		conn.seen(time.Now())
+	})
+
+	// The client reconnects by itself, it only concerns this connection so it isn't passed on
+	c.OnReconnectMessage(func(message twitch.ReconnectMessage) {
+		conn.seen(time.Now())
+
+		zap.S().Infof("Upstream connection %d was asked to reconnect", conn.id)
+	})
+
+	c.OnNamesMessage(func(message twitch.NamesMessage) {
+		p.raw(conn, message.Raw)
+	})
+
+	c.OnUnsetMessage(func(message twitch.RawMessage) {
+		p.raw(conn, message.Raw)
+	})
+}
+
+// Passes on a message sent to the account rather than a channel
+//
+// Every connection receives those, so only the ones received by the primary connection are passed on
+func (p *Pool) global(conn *connection, raw string) {
+	if !p.isPrimary(conn) {
+		conn.seen(time.Now())
+		return
+	}
+
+	p.raw(conn, raw)
+}
+
+// The primary connection is the oldest one still in the pool
+func (p *Pool) isPrimary(conn *connection) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.connections[conn.id]; !ok {
+		return false
+	}
+
+	for id := range p.connections {
+		if id < conn.id {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Pool) raw(conn *connection, raw string) {
+	conn.seen(time.Now())
+
+	if p.onRawMessage != nil {
+		p.onRawMessage(raw)
+	}
+}
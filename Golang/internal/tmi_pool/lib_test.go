@@ -0,0 +1,249 @@
+package tmipool
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v4"
+)
+
+// A pool which is never connected, so connections are created without dialing Twitch
+func newTestPool(perConnection int) *Pool {
+	return New(Options{
+		Username:              "justinfan123",
+		OAuth:                 "oauth:123",
+		ChannelsPerConnection: perConnection,
+	})
+}
+
+func channelNames(n int) []string {
+	channels := make([]string, n)
+	for i := range channels {
+		channels[i] = fmt.Sprintf("channel%d", i)
+	}
+
+	return channels
+}
+
+func checkAssigned(t *testing.T, p *Pool, channels []string, perConnection int) {
+	t.Helper()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, channel := range channels {
+		conn, ok := p.assigned[channel]
+		if !ok {
+			t.Errorf("Channel %s is not assigned", channel)
+			continue
+		}
+
+		if _, ok := p.connections[conn.id]; !ok {
+			t.Errorf("Channel %s is assigned to removed connection %d", channel, conn.id)
+		}
+	}
+
+	for _, conn := range p.connections {
+		if len(conn.channels) > perConnection {
+			t.Errorf("Connection %d has %d channels, more than %d", conn.id, len(conn.channels), perConnection)
+		}
+	}
+}
+
+func TestJoinSpreadsChannels(t *testing.T) {
+	p := newTestPool(50)
+	channels := channelNames(120)
+
+	p.Join(channels...)
+
+	infos := p.Connections()
+	if len(infos) != 3 {
+		t.Fatalf("Expected 3 connections, got %d", len(infos))
+	}
+
+	expected := []int{50, 50, 20}
+	for i, info := range infos {
+		if info.Channels != expected[i] {
+			t.Errorf("Expected connection %d to have %d channels, got %d", info.ID, expected[i], info.Channels)
+		}
+	}
+
+	checkAssigned(t, p, channels, 50)
+
+	// Joining again doesn't move or duplicate a channel
+	p.Join(channels[0])
+	if infos := p.Connections(); infos[0].Channels != 50 {
+		t.Errorf("Expected a joined channel not to be joined again, got %d channels", infos[0].Channels)
+	}
+}
+
+func TestDepartClosesIdleConnection(t *testing.T) {
+	p := newTestPool(2)
+	channels := channelNames(3)
+
+	p.Join(channels...)
+
+	if len(p.Connections()) != 2 {
+		t.Fatalf("Expected 2 connections, got %d", len(p.Connections()))
+	}
+
+	p.Depart(channels[2])
+
+	if infos := p.Connections(); len(infos) != 1 || infos[0].Channels != 2 {
+		t.Errorf("Expected the idle connection to be closed, got %v", infos)
+	}
+
+	// The last connection is kept around
+	p.Depart(channels[0])
+	p.Depart(channels[1])
+
+	if infos := p.Connections(); len(infos) != 1 || infos[0].Channels != 0 {
+		t.Errorf("Expected the last connection to be kept, got %v", infos)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	p := newTestPool(50)
+	channels := channelNames(120)
+
+	p.Join(channels...)
+
+	p.mu.Lock()
+	dead := p.connections[1]
+	moved := make([]string, 0, len(dead.channels))
+	for channel := range dead.channels {
+		moved = append(moved, channel)
+		delete(p.assigned, channel)
+	}
+	delete(p.connections, dead.id)
+	p.mu.Unlock()
+
+	p.rebalance(moved, 0)
+
+	checkAssigned(t, p, channels, 50)
+
+	total := 0
+	for _, info := range p.Connections() {
+		if info.ID == dead.id {
+			t.Error("Dead connection is still in the pool")
+		}
+
+		total += info.Channels
+	}
+
+	if total != len(channels) {
+		t.Errorf("Expected %d channels, got %d", len(channels), total)
+	}
+}
+
+func TestReapDeadConnection(t *testing.T) {
+	p := newTestPool(50)
+	channels := channelNames(60)
+
+	p.Join(channels...)
+
+	// Nothing has been received yet
+	p.reap(time.Now())
+	if len(p.Connections()) != 2 {
+		t.Fatal("Expected live connections to be kept")
+	}
+
+	p.mu.Lock()
+	p.connections[1].lastSeen.Store(time.Now().Add(-2 * deadAfter).UnixNano())
+	p.mu.Unlock()
+
+	p.reap(time.Now())
+
+	for _, info := range p.Connections() {
+		if info.ID == 1 {
+			t.Fatal("Expected the dead connection to be removed")
+		}
+	}
+
+	// Its channels are moved after the reconnect delay
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		p.mu.Lock()
+		assigned := len(p.assigned)
+		p.mu.Unlock()
+
+		if assigned == len(channels) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d channels to be moved, %d are assigned", len(channels), assigned)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	checkAssigned(t, p, channels, 50)
+}
+
+func TestLoginFailureBackoff(t *testing.T) {
+	p := newTestPool(50)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if d := p.delayFor(errors.New("connection reset")); d != minReconnectDelay {
+		t.Errorf("Expected %s, got %s", minReconnectDelay, d)
+	}
+
+	if d := p.delayFor(twitch.ErrLoginAuthenticationFailed); d < 30*time.Second {
+		t.Errorf("Expected a login failure to back off for longer, got %s", d)
+	}
+
+	for i := 0; i < 20; i++ {
+		p.delayFor(twitch.ErrLoginAuthenticationFailed)
+	}
+
+	if d := p.delayFor(twitch.ErrLoginAuthenticationFailed); d != maxLoginFailureDelay {
+		t.Errorf("Expected %s, got %s", maxLoginFailureDelay, d)
+	}
+}
+
+func TestGlobalMessagesFromOneConnection(t *testing.T) {
+	p := newTestPool(1)
+	p.Join(channelNames(3)...)
+
+	received := make([]string, 0)
+	p.OnRawMessage(func(raw string) {
+		received = append(received, raw)
+	})
+
+	p.mu.Lock()
+	conns := make([]*connection, 0, len(p.connections))
+	for id := 1; id <= 3; id++ {
+		conns = append(conns, p.connections[id])
+	}
+	p.mu.Unlock()
+
+	whisper := "@message-id=1 :forsen!forsen@forsen.tmi.twitch.tv WHISPER justinfan123 :hi"
+
+	// Every connection receives the same whisper
+	for _, conn := range conns {
+		p.global(conn, whisper)
+	}
+
+	if len(received) != 1 {
+		t.Fatalf("Expected the whisper to be passed on once, got %d", len(received))
+	}
+
+	// The next oldest connection takes over once the primary one is removed
+	p.mu.Lock()
+	conns[0].closed = true
+	p.remove(conns[0], nil)
+	p.mu.Unlock()
+
+	for _, conn := range conns {
+		p.global(conn, whisper)
+	}
+
+	if len(received) != 2 {
+		t.Errorf("Expected the whisper to be passed on once more, got %d", len(received))
+	}
+}
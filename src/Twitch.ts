@@ -38,6 +38,13 @@ function createConnection() {
 
 export const FIREHOSE_HOST = process.env.MELONBOT_FIREHOSE || '127.0.0.1';
 
+const FIREHOSE_CAPABILITIES = [
+	'twitch.tv/tags',
+	'twitch.tv/commands',
+	'twitch.tv/membership',
+	'melonbot/firehose',
+];
+
 export default class Twitch {
 	public client: DankTwitch.SingleConnection;
 
@@ -91,6 +98,8 @@ export default class Twitch {
 	}
 
 	private setupCallbacks() {
+		this.client.on('connect', this.OnTMIConnect.bind(this));
+
 		this.client.on('ready', this.OnTMIReady.bind(this));
 
 		this.client.on('PRIVMSG', this.OnTMIPrivmsg.bind(this));
@@ -153,6 +162,13 @@ export default class Twitch {
 		}
 	}
 
+	private OnTMIConnect() {
+		this.client.sendRaw(`PASS ${Bot.Config.Services.Firehose.Token}`);
+
+		// Firehose only sends what we ask for, firehose makes it send every channel instead of the ones we JOIN
+		this.client.sendRaw(`CAP REQ :${FIREHOSE_CAPABILITIES.join(' ')}`);
+	}
+
 	private async OnTMIReady() {
 		Bot.Log.Info('Twitch client ready');
 		this.initFlags[0] = true;
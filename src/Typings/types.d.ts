@@ -49,6 +49,7 @@ export type ServicesConfig = {
 	Firehose: {
 		Port: number;
 		HealthPort: number;
+		Token: string;
 	};
 	Website: {
 		JWTSecret: string;
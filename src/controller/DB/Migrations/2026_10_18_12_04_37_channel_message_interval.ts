@@ -0,0 +1,11 @@
+/** Lets a broadcaster ask for a longer interval between the bot's messages */
+
+import { Kysely } from 'kysely';
+
+export async function up(db: Kysely<any>): Promise<void> {
+	await db.schema.alterTable('channels').addColumn('message_interval', 'integer').execute();
+}
+
+export async function down(db: Kysely<any>): Promise<void> {
+	await db.schema.alterTable('channels').dropColumn('message_interval').execute();
+}
@@ -18,6 +18,12 @@ interface ChannelTable {
 	 * {4 = Bot} Own channel
 	 */
 	bot_permission: number;
+	/**
+	 * Milliseconds between messages the broadcaster asked for.
+	 *
+	 * Used on top of the bot permission interval, null if the broadcaster hasn't asked for one.
+	 */
+	message_interval: number | null;
 }
 
 type PermissionMode = 'Read' | 'Write' | 'VIP' | 'Moderator' | 'Bot';